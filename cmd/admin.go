@@ -0,0 +1,203 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	health "github.com/docker/go-healthcheck"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// leader is 1 when this instance holds the lock, or when no lock is used
+var leader int32
+
+// setLeader records whether this instance is the leader
+func setLeader(l bool) {
+	if l {
+		atomic.StoreInt32(&leader, 1)
+		return
+	}
+	atomic.StoreInt32(&leader, 0)
+}
+
+// isLeader returns true if this instance is the leader
+func isLeader() bool {
+	return atomic.LoadInt32(&leader) == 1
+}
+
+// role returns the role of this instance, leader or standby
+func role() string {
+	if isLeader() {
+		return "leader"
+	}
+	return "standby"
+}
+
+// adminTimeout bounds the time spent serving a read-only endpoint of the admin server
+const adminTimeout = 15 * time.Second
+
+// withTimeout limits the time spent serving a read-only endpoint.
+// The rotate and reconcile endpoints are not limited: they run the hooks synchronously,
+// and their response must report the outcome however long the hooks take.
+func withTimeout(h http.Handler) http.Handler {
+	return http.TimeoutHandler(h, adminTimeout, "Timeout serving the request")
+}
+
+// newAdminRouter creates the router of the admin server
+func newAdminRouter(stores []locksmith.Store) (*mux.Router, error) {
+	r := mux.NewRouter()
+	r.Handle("/livez", withTimeout(http.HandlerFunc(livezHandler))).Methods("GET")
+	r.Handle("/readyz", withTimeout(http.HandlerFunc(readyzHandler))).Methods("GET")
+	if cfg.Health {
+		r.Handle("/health", withTimeout(http.HandlerFunc(health.StatusHandler)))
+	}
+	if cfg.Metrics {
+		r.Handle("/metrics", withTimeout(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})))
+	}
+	if err := registerAdminAPI(r, stores); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// startAdminServer starts the admin server exposing health, readiness, metrics and the admin API.
+// It returns once the server listens on the configured address.
+func startAdminServer(stores []locksmith.Store) (*http.Server, error) {
+	router, err := newAdminRouter(stores)
+	if err != nil {
+		return nil, err
+	}
+	// No WriteTimeout: it would cut the response of a rotation whose hooks run longer.
+	// The read-only endpoints are bounded by withTimeout instead.
+	srv := &http.Server{
+		Handler:     router,
+		Addr:        cfg.Admin.Address,
+		ReadTimeout: 15 * time.Second,
+		IdleTimeout: 60 * time.Second,
+	}
+
+	useTLS := cfg.Admin.TLSCert != "" || cfg.Admin.TLSKey != ""
+	if useTLS {
+		tlsConfig, err := adminTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = tlsConfig
+	} else if cfg.Admin.ClientCA != "" {
+		return nil, errors.New("Client certificate authentication requires a TLS certificate and key")
+	}
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot listen on %s: %v", srv.Addr, err)
+	}
+	log.Infof("Admin server listening on %s", ln.Addr())
+
+	go func() {
+		var err error
+		if useTLS {
+			err = srv.ServeTLS(ln, cfg.Admin.TLSCert, cfg.Admin.TLSKey)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Admin server stopped: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+// adminTLSConfig returns the TLS configuration of the admin server.
+// Client certificates signed by the client CA are required if it is set.
+func adminTLSConfig() (*tls.Config, error) {
+	if cfg.Admin.TLSCert == "" || cfg.Admin.TLSKey == "" {
+		return nil, errors.New("Both TLS certificate and key must be provided")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.Admin.ClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.Admin.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %s", cfg.Admin.ClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// shutdownAdminServer gracefully stops the admin server
+func shutdownAdminServer(srv *http.Server) {
+	if srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("Error shutting down admin server: %v", err)
+	}
+}
+
+// livezHandler reports that the process is alive
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether the health checks pass, and whether this instance
+// is the leader or a standby
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := health.CheckStatus()
+	resp := map[string]interface{}{
+		"status": "ready",
+		"role":   role(),
+	}
+	status := http.StatusOK
+	if len(checks) != 0 {
+		resp["status"] = "unavailable"
+		resp["checks"] = checks
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
+
+// writeJSON writes v as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
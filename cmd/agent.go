@@ -0,0 +1,191 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/keystone"
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var agentOnce bool
+
+// agentCmd represents the agent command
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Write fernet keys from Vault(s) to a keystone key repository",
+	Long: `Watch the fernet keys in Vault(s) and write them to a keystone fernet key repository
+(by default /etc/keystone/fernet-keys/) as numbered files: 0 is the staging key and the highest
+number is the primary key. Files are replaced atomically and stale keys are removed,
+without keystone ever missing a key during an update.
+An optional reload command is run after each change.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		stores, err := createStores()
+		if err != nil {
+			log.Fatalf("Error creating stores: %v", err)
+		}
+		agent(stores)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(agentCmd)
+
+	agentCmd.Flags().String("key-repository", "/etc/keystone/fernet-keys/", "keystone fernet key repository")
+	agentCmd.Flags().String("owner", "", "user owning the key files (name or uid)")
+	agentCmd.Flags().String("group", "", "group owning the key files (name or gid)")
+	agentCmd.Flags().String("mode", "0600", "mode of the key files")
+	agentCmd.Flags().String("reload-command", "", "command run with sh -c after the keys changed")
+	agentCmd.Flags().BoolVar(&agentOnce, "once", false, "write the keys once and exit")
+
+	viper.BindPFlag("agent.keyRepository", agentCmd.Flags().Lookup("key-repository"))
+	viper.BindPFlag("agent.owner", agentCmd.Flags().Lookup("owner"))
+	viper.BindPFlag("agent.group", agentCmd.Flags().Lookup("group"))
+	viper.BindPFlag("agent.mode", agentCmd.Flags().Lookup("mode"))
+	viper.BindPFlag("agent.reloadCommand", agentCmd.Flags().Lookup("reload-command"))
+}
+
+func agent(stores []locksmith.Store) {
+	owner, err := keyOwner(cfg.Agent.Owner, cfg.Agent.Group)
+	if err != nil {
+		log.Fatalf("Invalid key owner: %v", err)
+	}
+	mode, err := strconv.ParseUint(cfg.Agent.Mode, 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid key mode %q: %v", cfg.Agent.Mode, err)
+	}
+
+	for _, v := range vaultClients(stores) {
+		if v.RenewToken || v.Auth != nil {
+			go keepAlive(v)
+		}
+	}
+
+	log.Infof("Writing keys to %s", cfg.Agent.KeyRepository)
+	ttl := time.Duration(cfg.TTL) * time.Second
+	watcher, watched := storeWatcher(stores)
+	if watcher != nil && !agentOnce {
+		log.Infof("Watching keys in %s", watched)
+	}
+
+	// run materialize() when the keys change, and at least every TTL
+	tick := time.Tick(ttl)
+	var index uint64
+	for {
+		err := materialize(stores, cfg.SecretPath, cfg.Agent.KeyRepository, owner, os.FileMode(mode))
+		if agentOnce {
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if err != nil {
+			log.Error(err)
+		}
+
+		if watcher == nil {
+			<-tick
+			continue
+		}
+		next, err := watcher.Watch(cfg.SecretPath, index, ttl)
+		if err != nil {
+			log.Warningf("Cannot watch keys in %s: %v", watched, err)
+			index = 0
+			<-tick
+			continue
+		}
+		index = next
+	}
+}
+
+// materialize reads the fernet keys from the first vault that can be read and writes them
+// to the key repository. It runs the reload command if the repository changed.
+func materialize(vlist []locksmith.Store, path string, dir string, owner keystone.Owner, mode os.FileMode) error {
+	var fkeys *locksmith.FernetKeys
+	var err error
+	for _, v := range vlist {
+		fkeys, err = locksmith.ReadFernetKeys(v, path)
+		if err == nil {
+			break
+		}
+		log.Warningf("Cannot read keys from %s: %v", v.Name(), err)
+	}
+	if fkeys == nil {
+		return fmt.Errorf("Cannot read keys from any vault: %v", err)
+	}
+
+	changed, err := keystone.WriteRepository(dir, fkeys.Keys, owner, mode)
+	if err != nil {
+		return fmt.Errorf("Cannot write keys to %s: %v", dir, err)
+	}
+	if !changed {
+		log.Debug("Key repository is up to date")
+		return nil
+	}
+	log.Infof("Key repository updated with keys created at %s, primary key %s", time.Unix(fkeys.CreationTime, 0).UTC().Format(time.RFC3339), fkeys.PrimaryFingerprint())
+
+	if cfg.Agent.ReloadCommand == "" {
+		return nil
+	}
+	log.Infof("Running reload command")
+	out, err := exec.Command("sh", "-c", cfg.Agent.ReloadCommand).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Reload command failed: %v: %s", err, out)
+	}
+	log.Debugf("Reload command output: %s", out)
+	return nil
+}
+
+// keyOwner resolves the owner and group of the key files. Names and numeric ids are accepted.
+func keyOwner(owner string, group string) (keystone.Owner, error) {
+	o := keystone.NoOwner
+	if owner != "" {
+		uid, err := strconv.Atoi(owner)
+		if err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return o, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return o, fmt.Errorf("Unsupported uid %s", u.Uid)
+			}
+		}
+		o.UID = uid
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return o, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return o, fmt.Errorf("Unsupported gid %s", g.Gid)
+			}
+		}
+		o.GID = gid
+	}
+	return o, nil
+}
@@ -0,0 +1,269 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// adminAPI serves the endpoints used to operate the keys watched by this instance
+type adminAPI struct {
+	vaults []locksmith.Store
+	path   string
+	ttl    int
+	token  string // Bearer token accepted by the API, empty when only client certificates are accepted
+}
+
+// keysStatus describes a set of fernet keys without revealing them
+type keysStatus struct {
+	Fingerprints []string `json:"fingerprints"`
+	Primary      string   `json:"primary"`
+	CreationTime string   `json:"creation_time"`
+	Period       int64    `json:"period"`
+	NextRotation string   `json:"next_rotation,omitempty"`
+}
+
+// vaultStatus describes the keys held by one vault
+type vaultStatus struct {
+	Address      string   `json:"address"`
+	Consistent   bool     `json:"consistent"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// rotateRequest is the optional body of a rotation request
+type rotateRequest struct {
+	Period int64 `json:"period"` // New period of rotation in seconds, 0 keeps the current period
+}
+
+// newKeysStatus returns the status of fkeys. The next rotation is omitted if the
+// schedule is misconfigured.
+func newKeysStatus(fkeys *locksmith.FernetKeys, ttl int) *keysStatus {
+	fingerprints := fkeys.Fingerprints()
+	ks := &keysStatus{
+		Fingerprints: fingerprints,
+		Primary:      fingerprints[len(fingerprints)-1],
+		CreationTime: time.Unix(fkeys.CreationTime, 0).UTC().Format(time.RFC3339),
+		Period:       fkeys.Period,
+	}
+	if next, err := nextRotationTime(fkeys, ttl); err == nil {
+		ks.NextRotation = next.UTC().Format(time.RFC3339)
+	}
+	return ks
+}
+
+// apiToken returns the bearer token protecting the admin API, if any
+func apiToken() (string, error) {
+	if cfg.Admin.Token != "" {
+		return cfg.Admin.Token, nil
+	}
+	if cfg.Admin.TokenFile != "" {
+		data, err := ioutil.ReadFile(cfg.Admin.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("Cannot read admin token file: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+// registerAdminAPI adds the admin API to the router of the admin server.
+// The API is only served when it can be protected by a bearer token or client certificates.
+// The token must not be sent in clear text, so it requires TLS unless the server only
+// listens on a loopback address.
+func registerAdminAPI(r *mux.Router, stores []locksmith.Store) error {
+	token, err := apiToken()
+	if err != nil {
+		return err
+	}
+	if token == "" && cfg.Admin.ClientCA == "" {
+		log.Info("Admin API disabled: neither an admin token nor a client CA is configured")
+		return nil
+	}
+	if token != "" && cfg.Admin.TLSCert == "" && !isLoopback(cfg.Admin.Address) {
+		return fmt.Errorf("The admin token requires a TLS certificate unless the admin server listens on a loopback address, not %s", cfg.Admin.Address)
+	}
+
+	api := &adminAPI{
+		vaults: stores,
+		path:   cfg.SecretPath,
+		ttl:    cfg.TTL,
+		token:  token,
+	}
+	s := r.PathPrefix("/v1").Subrouter()
+	s.Handle("/status", withTimeout(api.authenticate(api.statusHandler))).Methods("GET")
+	s.Handle("/rotate", api.authenticate(api.leaderOnly(api.rotateHandler))).Methods("POST")
+	s.Handle("/reconcile", api.authenticate(api.leaderOnly(api.reconcileHandler))).Methods("POST")
+	return nil
+}
+
+// isLoopback returns true if the listen address addr only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authenticate accepts requests presenting the bearer token or a verified client certificate
+func (a *adminAPI) authenticate(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			next(w, r)
+			return
+		}
+		if a.token != "" {
+			auth := r.Header.Get("Authorization")
+			if strings.HasPrefix(auth, "Bearer ") &&
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) == 1 {
+				next(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+	})
+}
+
+// leaderOnly refuses requests changing the keys when this instance does not hold the lock
+func (a *adminAPI) leaderOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isLeader() {
+			writeJSON(w, http.StatusConflict, map[string]string{
+				"error": "This instance does not hold the lock",
+				"role":  role(),
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// statusHandler reports the keys held by each vault and whether they are identical
+func (a *adminAPI) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := loadPolicy(); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Invalid schedule configuration: %v", err))
+		return
+	}
+	resp := struct {
+		Role       string        `json:"role"`
+		Consistent bool          `json:"consistent"`
+		Keys       *keysStatus   `json:"keys,omitempty"`
+		Vaults     []vaultStatus `json:"vaults"`
+	}{
+		Role:       role(),
+		Consistent: true,
+	}
+
+	// The keys of the first vault are the reference, as in the watch loop
+	var ref *locksmith.FernetKeys
+	for i, v := range a.vaults {
+		vs := vaultStatus{Address: v.Name()}
+		fkeys, err := locksmith.ReadFernetKeys(v, a.path)
+		if err != nil {
+			vs.Error = err.Error()
+		} else {
+			vs.Fingerprints = fkeys.Fingerprints()
+			if i == 0 {
+				ref = fkeys
+				resp.Keys = newKeysStatus(fkeys, a.ttl)
+			}
+			vs.Consistent = ref != nil && ref.Equal(fkeys)
+		}
+		resp.Consistent = resp.Consistent && vs.Consistent
+		resp.Vaults = append(resp.Vaults, vs)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// rotateHandler rotates the keys immediately, optionally changing the period of rotation
+func (a *adminAPI) rotateHandler(w http.ResponseWriter, r *http.Request) {
+	var req rotateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if req.Period < 0 {
+		writeError(w, http.StatusBadRequest, "Period must be positive")
+		return
+	}
+
+	smithMu.Lock()
+	defer smithMu.Unlock()
+
+	log.Info("Rotation requested through the admin API")
+	fkeys, err := currentFernetKeys(a.vaults, a.path, a.ttl)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Cannot read keys: %v", err))
+		return
+	}
+	if err := rotateFernetKeys(a.vaults, a.path, fkeys, req.Period, a.ttl); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "rotated",
+		"keys":   newKeysStatus(fkeys, a.ttl),
+	})
+}
+
+// reconcileHandler repairs the vaults holding keys different from the authoritative keys
+func (a *adminAPI) reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	smithMu.Lock()
+	defer smithMu.Unlock()
+
+	log.Info("Reconciliation requested through the admin API")
+	fkeys, repaired, err := locksmith.Reconcile(a.vaults, a.path, reconcileOptions(), a.ttl)
+	for _, name := range repaired {
+		log.Infof("Keys repaired in %s", name)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Reconciliation failed: %v", err))
+		return
+	}
+	keysDiverged.Set(0)
+	observeKeys(fkeys, a.ttl)
+	if repaired == nil {
+		repaired = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "reconciled",
+		"repaired": repaired,
+		"keys":     newKeysStatus(fkeys, a.ttl),
+	})
+}
+
+// writeError writes an error as the JSON body of a response
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
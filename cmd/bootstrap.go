@@ -17,8 +17,8 @@ package cmd
 import (
 	"fmt"
 
+	"github.com/aevox/vault-fernet-locksmith/pkg/hooks"
 	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
-	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -29,19 +29,19 @@ var forceBootstrap bool
 
 // bootstrapCmd represents the bootstrap command
 var bootstrapCmd = &cobra.Command{
-	Use:   "bootstrap",
-	Short: "Generate first set of fernet keys in Vault(s)",
+	Use:         "bootstrap",
+	Short:       "Generate first set of fernet keys in Vault(s)",
+	Annotations: supportsDryRun,
 	Long: `Create n fernet keys (n > 2) and store them as a secret in Vault(s).
-The secret is a list of keys with associated with a creation time, a TTL and a period.`,
-	// TODO:
-	// If a secret alreay exists in the primary Vault, it copies it into the the secondary Vaults
+The secret is a list of keys with associated with a creation time, a TTL and a period.
+To copy keys that already exist in the primary Vault to new secondary Vaults, use the sync command.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		vaultClients, err := createVaultClients()
+		stores, err := createStores()
 		if err != nil {
-			log.Fatalf("Error creating vault clients: %v", err)
+			log.Fatalf("Error creating stores: %v", err)
 		}
 
-		bootstrap(vaultClients)
+		bootstrap(stores)
 	},
 }
 
@@ -56,7 +56,10 @@ func init() {
 	viper.BindPFlag("bootstrap.period", bootstrapCmd.Flags().Lookup("period"))
 }
 
-func bootstrap(vaultClients []*vault.Vault) {
+func bootstrap(stores []locksmith.Store) {
+	checkHooks()
+	checkSink()
+
 	if cfg.Bootstrap.NumKeys < 3 {
 		log.Fatal("Keys number must be superior to 3")
 	}
@@ -71,27 +74,45 @@ func bootstrap(vaultClients []*vault.Vault) {
 		log.Fatalf("Error creating new fernet keys: %v", err)
 	}
 
+	plan := &locksmith.Plan{Operation: "bootstrap", Path: cfg.SecretPath}
 	// Write fernet keys to Vault
-	for _, v := range vaultClients {
-		log.Debugf("Reading secret in %s", v.Client.Address())
-		s, err := v.Read(cfg.SecretPath)
+	versions := make([]int, len(stores))
+	for i, v := range stores {
+		log.Debugf("Reading secret in %s", v.Name())
+		s, version, err := v.ReadVersion(cfg.SecretPath)
 		if err != nil {
-			log.Fatalf("Cannot read secret from %s: %v", v.Client.Address(), err)
+			log.Fatalf("Cannot read secret from %s: %v", v.Name(), err)
 		}
 
 		// Exit if keys already exist. Continue if the option --force is set.
 		if !forceBootstrap {
 			if s != nil {
-				log.Fatalf("Keys already exist in Vault %s. Use the option --force if you want to bootstrap over it", v.Client.Address())
+				log.Fatalf("Keys already exist in %s. Use the sync command to copy them to other vaults, or the option --force if you want to bootstrap over it", v.Name())
+			}
+		}
+		versions[i] = version
+
+		if cfg.DryRun {
+			var current *locksmith.FernetKeys
+			if s != nil {
+				if current, err = locksmith.DecodeFernetKeys(s); err != nil {
+					plan.Note(fmt.Sprintf("Existing secret in %s is not valid fernet keys: %v", v.Name(), err))
+				}
 			}
+			plan.Add(v.Name(), current, fernetKeys)
 		}
 	}
+	if cfg.DryRun {
+		exitWithPlan(plan)
+	}
 
-	for _, v := range vaultClients {
-		log.Infof("Writing keys to %s", v.Client.Address())
-		if err := locksmith.WriteFernetKeys(v, cfg.SecretPath, fernetKeys, cfg.TTL); err != nil {
-			log.Fatalf("Error bootstraping keys: Error writing keys to %s : %v", v.Client.Address(), err)
+	for i, v := range stores {
+		log.Infof("Writing keys to %s", v.Name())
+		if _, err := locksmith.WriteFernetKeys(v, cfg.SecretPath, fernetKeys, cfg.TTL, versions[i]); err != nil {
+			log.Fatalf("Error bootstraping keys: Error writing keys to %s : %v", v.Name(), err)
 		}
 	}
-	fmt.Println("Bootstrap done")
+	writeSink(fernetKeys)
+	notifyHooks(hooks.EventBootstrap, stores, fernetKeys)
+	fmt.Printf("Bootstrap done, primary key %s\n", fernetKeys.PrimaryFingerprint())
 }
@@ -18,7 +18,8 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
+	"github.com/aevox/vault-fernet-locksmith/pkg/hooks"
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -27,14 +28,15 @@ var forceDelete bool
 
 // deleteCmd represents the delete command
 var deleteCmd = &cobra.Command{
-	Use:   "delete",
-	Short: "Delete fernet keys secret in Vault(s)",
+	Use:         "delete",
+	Short:       "Delete fernet keys secret in Vault(s)",
+	Annotations: supportsDryRun,
 	Run: func(cmd *cobra.Command, args []string) {
-		vaultClients, err := createVaultClients()
+		stores, err := createStores()
 		if err != nil {
-			log.Fatalf("Error creating vault clients: %v", err)
+			log.Fatalf("Error creating stores: %v", err)
 		}
-		deleteSecrets(vaultClients)
+		deleteSecrets(stores)
 	},
 }
 
@@ -44,20 +46,50 @@ func init() {
 	deleteCmd.Flags().BoolVar(&forceDelete, "force", false, "force deletion")
 }
 
-func deleteSecrets(vaultClients []*vault.Vault) {
+func deleteSecrets(stores []locksmith.Store) {
+	checkHooks()
+
+	if cfg.DryRun {
+		plan := &locksmith.Plan{Operation: "delete", Path: cfg.SecretPath}
+		for _, v := range stores {
+			s, err := v.Read(cfg.SecretPath)
+			if err != nil {
+				log.Fatalf("Cannot read secret from %s: %v", v.Name(), err)
+			}
+			if s == nil {
+				plan.Add(v.Name(), nil, nil)
+				continue
+			}
+			current, err := locksmith.ReadFernetKeys(v, cfg.SecretPath)
+			if err != nil {
+				// The secret is deleted anyway, but its keys cannot be described
+				plan.Note(fmt.Sprintf("Secret in %s is not valid fernet keys: %v", v.Name(), err))
+				plan.Changes = append(plan.Changes, locksmith.Change{Vault: v.Name(), Changed: true, Current: []string{}, Result: []string{}})
+				continue
+			}
+			plan.Add(v.Name(), current, nil)
+		}
+		exitWithPlan(plan)
+	}
+
 	var input string
 	if !forceDelete {
 		fmt.Printf("Delete %s (y/N):", cfg.SecretPath)
 		fmt.Scanln(&input)
 	}
 	if input == "y" || input == "Y" || input == "yes" || forceDelete {
-		for _, v := range vaultClients {
+		var deleted []locksmith.Store
+		for _, v := range stores {
 			if err := v.Delete(cfg.SecretPath); err != nil {
-				log.Errorf("Error Deleting secret in %s: %v", v.Client.Address(), err)
+				log.Errorf("Error Deleting secret in %s: %v", v.Name(), err)
 			} else {
-				fmt.Printf("%s deleted in vault %s\n", cfg.SecretPath, v.Client.Address())
+				fmt.Printf("%s deleted in %s\n", cfg.SecretPath, v.Name())
+				deleted = append(deleted, v)
 			}
 		}
+		if len(deleted) != 0 {
+			notifyHooks(hooks.EventDelete, deleted, nil)
+		}
 	} else {
 		fmt.Println("Doing nothing")
 	}
@@ -0,0 +1,214 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the diff command, as diff(1)
+const (
+	diffIdentical = 0
+	diffDifferent = 1
+	diffTrouble   = 2
+)
+
+var diffOutput string
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:         "diff",
+	Short:       "Compare the fernet keys of Vault(s) and recommend how to reconcile them",
+	Annotations: supportsDryRun,
+	Long: `Read the fernet keys of every Vault and show, for each key position, which Vaults hold which key.
+Keys are identified by their fingerprints. Each Vault is compared with the authoritative keys selected by
+the reconciliation strategy: identical, same keys with different metadata, one or more rotations behind or
+ahead, sharing some keys, or unrelated.
+A reconciliation action is recommended for each difference.
+The exit code is 0 if the keys are identical, 1 if they differ and 2 on error.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		log.StandardLogger().ExitFunc = func(int) { os.Exit(diffTrouble) }
+
+		stores, err := createStores()
+		if err != nil {
+			log.Fatalf("Error creating stores: %v", err)
+		}
+		diff(stores)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().StringVarP(&diffOutput, "output", "o", "table", "output format (table, json)")
+}
+
+// diffReport is the comparison of the keys of every vault
+type diffReport struct {
+	*locksmith.Diff
+	Strategy        string            `json:"strategy"`
+	Unreadable      []unreadableVault `json:"unreadable,omitempty"`
+	Recommendations []string          `json:"recommendations"`
+}
+
+// unreadableVault is a vault whose keys could not be read
+type unreadableVault struct {
+	Vault string `json:"vault"`
+	Error string `json:"error"`
+}
+
+func diff(stores []locksmith.Store) {
+	if diffOutput != "table" && diffOutput != "json" {
+		log.Fatalf("Unknown output format %q", diffOutput)
+	}
+
+	report, err := newDiffReport(stores)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if diffOutput == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("Cannot print diff: %v", err)
+		}
+		fmt.Println(string(b))
+	} else {
+		printDiff(report)
+	}
+
+	if report.Identical() && len(report.Unreadable) == 0 {
+		os.Exit(diffIdentical)
+	}
+	os.Exit(diffDifferent)
+}
+
+// newDiffReport compares the keys of every readable vault with the authoritative keys
+func newDiffReport(stores []locksmith.Store) (*diffReport, error) {
+	opts := reconcileOptions()
+	report := &diffReport{Strategy: string(opts.Strategy)}
+	if report.Strategy == "" {
+		report.Strategy = string(locksmith.StrategyPrimary)
+	}
+
+	var names []string
+	var keysets []*locksmith.FernetKeys
+	for _, v := range stores {
+		fkeys, err := locksmith.ReadFernetKeys(v, cfg.SecretPath)
+		if err != nil {
+			report.Unreadable = append(report.Unreadable, unreadableVault{v.Name(), err.Error()})
+			continue
+		}
+		names = append(names, v.Name())
+		keysets = append(keysets, fkeys)
+	}
+	if len(keysets) == 0 {
+		return nil, fmt.Errorf("Cannot read keys in any vault")
+	}
+
+	a, err := locksmith.Authoritative(keysets, opts.Strategy)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot select the authoritative keys: %v", err)
+	}
+	report.Diff = locksmith.NewDiff(names, keysets, a)
+	report.Recommendations = recommend(report, keysets[a])
+	return report, nil
+}
+
+// recommend returns the actions reconciling the vaults with the authoritative keys
+func recommend(report *diffReport, authoritative *locksmith.FernetKeys) []string {
+	var actions []string
+	for _, u := range report.Unreadable {
+		actions = append(actions, fmt.Sprintf("Fix access to %s before reconciling: %s", u.Vault, u.Error))
+	}
+
+	ref := report.Reference
+	for _, r := range report.Relations {
+		switch r.Kind {
+		case locksmith.RelationBehind:
+			detail := ""
+			if r.Rotations == 1 {
+				detail = fmt.Sprintf(" (its primary key is a secondary key of %s)", ref)
+			}
+			actions = append(actions, fmt.Sprintf(
+				"%s is %d rotation(s) behind %s%s: run `reconcile` to copy the authoritative keys, "+
+					"tokens issued with its %d shared key(s) remain valid",
+				r.Vault, r.Rotations, ref, detail, r.Shared))
+		case locksmith.RelationMetadata:
+			actions = append(actions, fmt.Sprintf(
+				"%s holds the same keys as %s with a different period or creation time: "+
+					"run `reconcile` to copy the authoritative keys (add --reconcile-allow-newer if its creation time is newer)",
+				r.Vault, ref))
+		case locksmith.RelationAhead:
+			actions = append(actions, fmt.Sprintf(
+				"%s is %d rotation(s) ahead of %s: the authoritative keys are outdated, "+
+					"run `reconcile --reconcile-strategy newest` to propagate the newest keys",
+				r.Vault, r.Rotations, ref))
+		case locksmith.RelationDiverged:
+			actions = append(actions, fmt.Sprintf(
+				"%s shares %d of %d key(s) with %s but is not a rotation of its keys: "+
+					"check who wrote them, then run `reconcile` (raise --reconcile-max-divergence if it is refused)",
+				r.Vault, r.Shared, len(authoritative.Keys), ref))
+		case locksmith.RelationUnrelated:
+			actions = append(actions, fmt.Sprintf(
+				"%s shares no key with %s: its keys may have been replaced or tampered with. "+
+					"Investigate before running `reconcile --reconcile-allow-disjoint`, which invalidates every token issued with them",
+				r.Vault, ref))
+		}
+	}
+	if len(actions) == 0 {
+		actions = append(actions, "Nothing to do, keys are identical in each vault")
+	}
+	return actions
+}
+
+// printDiff prints the keys by position, the relation of each vault to the
+// authoritative keys and the recommended actions
+func printDiff(report *diffReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POSITION\tROLE\tFINGERPRINT\tVAULTS")
+	for _, p := range report.Positions {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", p.Position, p.Role, p.Fingerprint, strings.Join(p.Vaults, ", "))
+	}
+	w.Flush()
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "VAULT\tRELATION TO %s (%s)\tSHARED KEYS\n", report.Reference, report.Strategy)
+	for _, r := range report.Relations {
+		relation := r.Kind
+		if r.Rotations > 0 {
+			relation = fmt.Sprintf("%s by %d rotation(s)", r.Kind, r.Rotations)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\n", r.Vault, relation, r.Shared)
+	}
+	for _, u := range report.Unreadable {
+		fmt.Fprintf(w, "%s\tunreadable\t-\n", u.Vault)
+	}
+	w.Flush()
+	fmt.Println()
+
+	for _, a := range report.Recommendations {
+		fmt.Printf("* %s\n", a)
+	}
+}
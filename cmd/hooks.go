@@ -0,0 +1,144 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/hooks"
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	hooksOnce  sync.Once
+	keyHooks   []*hooks.Hook
+	errHookCfg error
+)
+
+// loadHooks returns the hooks of the configuration
+func loadHooks() ([]*hooks.Hook, error) {
+	hooksOnce.Do(func() {
+		for i, c := range cfg.Hooks {
+			h, err := newHook(i, c)
+			if err != nil {
+				errHookCfg = err
+				return
+			}
+			keyHooks = append(keyHooks, h)
+		}
+	})
+	return keyHooks, errHookCfg
+}
+
+// newHook creates the i-th hook of the configuration
+func newHook(i int, c HookConfiguration) (*hooks.Hook, error) {
+	h := &hooks.Hook{
+		Name:          c.Name,
+		Command:       c.Command,
+		URL:           c.URL,
+		Secret:        c.Secret,
+		Timeout:       time.Duration(c.Timeout) * time.Second,
+		Retries:       c.Retries,
+		RetryInterval: time.Duration(c.RetryInterval) * time.Second,
+		IncludeKeys:   c.IncludeKeys,
+		Veto:          c.Veto,
+	}
+	if h.Name == "" {
+		h.Name = fmt.Sprintf("#%d", i)
+	}
+	for _, e := range c.Events {
+		h.Events = append(h.Events, hooks.Event(e))
+	}
+	if h.Secret == "" && c.SecretFile != "" {
+		data, err := ioutil.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read secret file of hook %s: %v", h.Name, err)
+		}
+		h.Secret = strings.TrimSpace(string(data))
+	}
+	if err := h.Check(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// checkHooks exits if the hooks are misconfigured
+func checkHooks() {
+	if _, err := loadHooks(); err != nil {
+		log.Fatalf("Invalid hooks configuration: %v", err)
+	}
+}
+
+// runHooks runs the hooks triggered by event with the metadata of fkeys.
+// fkeys may be nil when the keys were deleted.
+func runHooks(event hooks.Event, vlist []locksmith.Store, fkeys *locksmith.FernetKeys) error {
+	hs, err := loadHooks()
+	if err != nil {
+		return err
+	}
+	if len(hs) == 0 {
+		return nil
+	}
+
+	p := &hooks.Payload{
+		Event:     event,
+		Path:      cfg.SecretPath,
+		Timestamp: time.Now().Unix(),
+	}
+	for _, v := range vlist {
+		p.Vaults = append(p.Vaults, v.Name())
+	}
+	if fkeys != nil {
+		p.Fingerprints = fkeys.Fingerprints()
+		p.Primary = p.Fingerprints[len(p.Fingerprints)-1]
+		p.CreationTime = fkeys.CreationTime
+		p.Period = fkeys.Period
+		p.Keys = fkeys.Keys
+	}
+
+	log.Debugf("Running %s hooks", event)
+	err = hooks.Run(hs, p)
+	if herr, ok := err.(*hooks.Error); ok {
+		for _, f := range herr.Failures {
+			log.WithField("hook", f.Hook).WithField("event", string(event)).Warnf("Hook failed: %v", f.Err)
+		}
+	}
+	return err
+}
+
+// notifyHooks runs the hooks triggered by event. Failures are only logged.
+func notifyHooks(event hooks.Event, vlist []locksmith.Store, fkeys *locksmith.FernetKeys) {
+	runHooks(event, vlist, fkeys)
+}
+
+// preRotationHooks runs the pre-rotation hooks with the keys about to be written.
+// It returns an error if a hook allowed to veto the rotation failed.
+func preRotationHooks(vlist []locksmith.Store, next *locksmith.FernetKeys) error {
+	err := runHooks(hooks.EventPreRotation, vlist, next)
+	if herr, ok := err.(*hooks.Error); ok && !herr.Vetoed() {
+		return nil
+	}
+	if err != nil {
+		return errors.New("Rotation vetoed by pre-rotation hooks")
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/keystone"
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importKeyRepository string
+	importCreationTime  int64
+	importPeriod        int64
+	forceImport         bool
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:         "import",
+	Short:       "Import the fernet keys of a keystone key repository in Vault(s)",
+	Annotations: supportsDryRun,
+	Long: `Read the fernet keys of an existing keystone key repository (numbered files, 0 being the staging key
+and the highest number the primary key) and store them as a secret in Vault(s).
+Tokens issued with these keys stay valid, which makes it possible to migrate clusters running
+keystone-manage fernet_rotate without bootstrapping new keys.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		stores, err := createStores()
+		if err != nil {
+			log.Fatalf("Error creating stores: %v", err)
+		}
+		importKeys(stores)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVar(&importKeyRepository, "key-repository", "/etc/keystone/fernet-keys/", "keystone fernet key repository to import")
+	importCmd.Flags().Int64Var(&importCreationTime, "creation-time", 0, "creation time of the keys as a unix timestamp. Defaults to now")
+	importCmd.Flags().Int64VarP(&importPeriod, "period", "p", 0, "period between each key rotation in seconds")
+	importCmd.Flags().BoolVar(&forceImport, "force", false, "force import over existing keys")
+}
+
+func importKeys(stores []locksmith.Store) {
+	if importPeriod <= 0 {
+		log.Fatal("Keys period must be superior to 0")
+	}
+	creationTime := importCreationTime
+	if creationTime == 0 {
+		creationTime = time.Now().Unix()
+	}
+
+	keys, err := keystone.ReadRepository(importKeyRepository)
+	if err != nil {
+		log.Fatalf("Cannot read key repository: %v", err)
+	}
+	fernetKeys := &locksmith.FernetKeys{
+		Keys:         keys,
+		CreationTime: creationTime,
+		Period:       importPeriod,
+	}
+	if err := fernetKeys.CheckFormat(); err != nil {
+		log.Fatalf("Keys have wrong format: %v", err)
+	}
+	log.Infof("Read %d keys from %s", len(keys), importKeyRepository)
+
+	plan := &locksmith.Plan{Operation: "import", Path: cfg.SecretPath}
+	versions := make([]int, len(stores))
+	for i, v := range stores {
+		log.Debugf("Reading secret in %s", v.Name())
+		s, version, err := v.ReadVersion(cfg.SecretPath)
+		if err != nil {
+			log.Fatalf("Cannot read secret from %s: %v", v.Name(), err)
+		}
+
+		// Exit if keys already exist. Continue if the option --force is set.
+		if s != nil && !forceImport {
+			log.Fatalf("Keys already exist in %s. Use the option --force if you want to import over it", v.Name())
+		}
+		versions[i] = version
+
+		if cfg.DryRun {
+			var current *locksmith.FernetKeys
+			if s != nil {
+				if current, err = locksmith.DecodeFernetKeys(s); err != nil {
+					plan.Note(fmt.Sprintf("Existing secret in %s is not valid fernet keys: %v", v.Name(), err))
+				}
+			}
+			plan.Add(v.Name(), current, fernetKeys)
+		}
+	}
+	if cfg.DryRun {
+		exitWithPlan(plan)
+	}
+
+	for i, v := range stores {
+		log.Infof("Writing keys to %s", v.Name())
+		if _, err := locksmith.WriteFernetKeys(v, cfg.SecretPath, fernetKeys, cfg.TTL, versions[i]); err != nil {
+			log.Fatalf("Error importing keys: Error writing keys to %s : %v", v.Name(), err)
+		}
+	}
+	fmt.Println("Import done")
+}
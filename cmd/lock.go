@@ -0,0 +1,130 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/consul"
+	"github.com/aevox/vault-fernet-locksmith/pkg/kubernetes"
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
+
+	health "github.com/docker/go-healthcheck"
+)
+
+// lockBackend returns the backend of the lock electing the watch instance rotating
+// the keys, or an empty string if no lock is used. consul.lock enables the consul lock.
+func lockBackend() string {
+	if cfg.Lock.Backend != "" {
+		return cfg.Lock.Backend
+	}
+	if cfg.Consul.Lock {
+		return "consul"
+	}
+	return ""
+}
+
+// newLocker creates the lock of the configuration. It returns nil if no lock is used.
+// The vault lock is held in the first vault of stores.
+func newLocker(stores []locksmith.Store) (locksmith.Locker, error) {
+	switch lockBackend() {
+	case "":
+		return nil, nil
+	case "consul":
+		consulClient, err := newConsulClient()
+		if err != nil {
+			return nil, err
+		}
+		return consul.NewLock(consulClient, cfg.Consul.LockKey), nil
+	case "kubernetes":
+		c, err := newKubernetesClient()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create Kubernetes client: %v", err)
+		}
+		identity, err := lockIdentity()
+		if err != nil {
+			return nil, err
+		}
+		l := kubernetes.NewLeaseLock(c, cfg.Lock.Namespace, cfg.Lock.Name, identity)
+		l.LeaseDuration = time.Duration(cfg.Lock.LeaseDuration) * time.Second
+		l.RenewDeadline = time.Duration(cfg.Lock.RenewDeadline) * time.Second
+		l.RetryPeriod = time.Duration(cfg.Lock.RetryPeriod) * time.Second
+		if err := l.Check(); err != nil {
+			return nil, fmt.Errorf("Invalid lock configuration: %v", err)
+		}
+		return l, nil
+	case "vault":
+		vcs := vaultClients(stores)
+		if len(vcs) == 0 {
+			return nil, errors.New("The vault lock requires a vault")
+		}
+		identity, err := lockIdentity()
+		if err != nil {
+			return nil, err
+		}
+		path := cfg.Lock.Path
+		if path == "" {
+			path = cfg.SecretPath + ".lock"
+		}
+		l := vault.NewLock(vcs[0], path, identity)
+		l.TTL = time.Duration(cfg.Lock.LeaseDuration) * time.Second
+		l.RenewDeadline = time.Duration(cfg.Lock.RenewDeadline) * time.Second
+		l.RetryPeriod = time.Duration(cfg.Lock.RetryPeriod) * time.Second
+		if err := l.Check(); err != nil {
+			return nil, fmt.Errorf("Invalid lock configuration: %v", err)
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("Unknown lock backend %q", cfg.Lock.Backend)
+	}
+}
+
+// lockIdentity returns the identity of this instance in the lock: the configured
+// identity, or the hostname followed by a random suffix so that two instances
+// running on the same host are told apart
+func lockIdentity() (string, error) {
+	if cfg.Lock.Identity != "" {
+		return cfg.Lock.Identity, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("Cannot get hostname: %v", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return hostname + "_" + hex.EncodeToString(suffix), nil
+}
+
+// lockChecker checks that the lock is held by an instance
+func lockChecker(l locksmith.Locker) health.Checker {
+	return health.CheckFunc(func() error {
+		holder, err := l.Holder()
+		if err != nil {
+			return err
+		}
+		if holder == "" {
+			return errors.New("Lock is not held")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,143 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics exposed on /metrics by the watch command
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	keysCreationTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "locksmith_keyset_creation_timestamp_seconds",
+		Help: "Creation time of the fernet keys, as a unix timestamp.",
+	})
+	lastRotation = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "locksmith_last_rotation_timestamp_seconds",
+		Help: "Time of the last successful rotation by this instance, as a unix timestamp.",
+	})
+	nextRotation = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "locksmith_next_rotation_timestamp_seconds",
+		Help: "Time of the next scheduled rotation, as a unix timestamp.",
+	})
+	keysCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "locksmith_keys",
+		Help: "Number of fernet keys in the keyset.",
+	})
+	keysDiverged = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "locksmith_keys_diverged",
+		Help: "1 if the vaults do not hold identical keys, 0 otherwise.",
+	})
+	lockHeld = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "locksmith_lock_held",
+		Help: "1 if this instance holds the lock, 0 otherwise.",
+	})
+	rotationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "locksmith_rotation_failures_total",
+		Help: "Number of rotations that could not be committed to every vault.",
+	})
+	sinkFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "locksmith_kubernetes_secret_failures_total",
+		Help: "Number of failed writes of the keys to the Kubernetes secret.",
+	})
+	tokenRenewalFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "locksmith_vault_token_renewal_failures_total",
+		Help: "Number of failed vault token renewals.",
+	}, []string{"vault"})
+	vaultRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "locksmith_vault_request_duration_seconds",
+		Help: "Latency of vault requests.",
+	}, []string{"vault", "operation"})
+	vaultRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "locksmith_vault_request_errors_total",
+		Help: "Number of failed vault requests.",
+	}, []string{"vault", "operation"})
+
+	sinceLastRotation = newSinceMetric("locksmith_seconds_since_last_rotation",
+		"Seconds since the last successful rotation by this instance.")
+	keysAge = newSinceMetric("locksmith_keyset_age_seconds",
+		"Age of the fernet keys in seconds.")
+)
+
+func init() {
+	metricsRegistry.MustRegister(keysCreationTime, lastRotation, nextRotation, keysCount, keysDiverged, lockHeld,
+		rotationFailures, sinkFailures, tokenRenewalFailures, vaultRequestDuration, vaultRequestErrors,
+		sinceLastRotation, keysAge)
+}
+
+// sinceMetric is a gauge of the seconds elapsed since a time. It is not collected
+// until the time is known.
+type sinceMetric struct {
+	unix int64 // Unix time, accessed atomically. 0 until the time is known.
+	desc *prometheus.Desc
+}
+
+func newSinceMetric(name, help string) *sinceMetric {
+	return &sinceMetric{desc: prometheus.NewDesc(name, help, nil, nil)}
+}
+
+// Set sets the time to measure the elapsed seconds from
+func (m *sinceMetric) Set(t time.Time) {
+	atomic.StoreInt64(&m.unix, t.Unix())
+}
+
+// Describe implements prometheus.Collector
+func (m *sinceMetric) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.desc
+}
+
+// Collect implements prometheus.Collector
+func (m *sinceMetric) Collect(ch chan<- prometheus.Metric) {
+	t := atomic.LoadInt64(&m.unix)
+	if t == 0 {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, float64(time.Now().Unix()-t))
+}
+
+// instrumentVault records the latency and errors of the requests of a vault client
+func instrumentVault(v *vault.Vault) {
+	name := v.Name()
+	v.Observe = func(operation string, d time.Duration, err error) {
+		vaultRequestDuration.WithLabelValues(name, operation).Observe(d.Seconds())
+		if err != nil {
+			vaultRequestErrors.WithLabelValues(name, operation).Inc()
+		}
+	}
+}
+
+// observeKeys updates the metrics describing the keys read from or written to the vaults
+func observeKeys(fkeys *locksmith.FernetKeys, ttl int) {
+	keysCreationTime.Set(float64(fkeys.CreationTime))
+	keysAge.Set(time.Unix(fkeys.CreationTime, 0))
+	keysCount.Set(float64(len(fkeys.Keys)))
+	if next, err := nextRotationTime(fkeys, ttl); err == nil {
+		nextRotation.Set(float64(next.Unix()))
+	}
+}
+
+// observeRotation updates the metrics after a successful rotation by this instance
+func observeRotation(at time.Time) {
+	lastRotation.Set(float64(at.Unix()))
+	sinceLastRotation.Set(at)
+}
@@ -0,0 +1,59 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of dry runs
+const (
+	exitNoChange = 0 // The command would not change anything
+	exitChange   = 2 // The command would change the keys
+)
+
+// dryRunAnnotation marks the commands supporting --dry-run: the mutating commands
+// that can print a plan and the commands that never change the keys
+const dryRunAnnotation = "dryRun"
+
+var supportsDryRun = map[string]string{dryRunAnnotation: "true"}
+
+// checkDryRun exits if --dry-run is set for a command that does not support it,
+// rather than letting it change the keys
+func checkDryRun(cmd *cobra.Command) {
+	if cfg.DryRun && cmd.Annotations[dryRunAnnotation] == "" {
+		log.Fatalf("The %s command does not support --dry-run", cmd.Name())
+	}
+}
+
+// exitWithPlan prints the plan and exits with a code telling whether it changes the keys
+func exitWithPlan(p *locksmith.Plan) {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		log.Fatalf("Cannot print plan: %v", err)
+	}
+	fmt.Println(string(b))
+	if p.Changed() {
+		os.Exit(exitChange)
+	}
+	os.Exit(exitNoChange)
+}
@@ -15,40 +15,186 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
 
-	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	printShowKeys bool
+	printOutput   string
 )
 
 // printCmd represents the print command
 var printCmd = &cobra.Command{
-	Use:   "print",
-	Short: "Print secrets stored in Vault(s)",
+	Use:         "print",
+	Short:       "Print secrets stored in Vault(s)",
+	Annotations: supportsDryRun,
+	Long: `Print the fernet keys stored in Vault(s) as a table, JSON or YAML, and whether every Vault holds the same keys.
+Keys are identified by their fingerprints: the first 16 hexadecimal characters of their SHA-256 hash.
+Use --show-keys to print the raw keys.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		vaultClients, err := createVaultClients()
+		stores, err := createStores()
 		if err != nil {
-			log.Fatalf("Error creating vault clients: %v", err)
+			log.Fatalf("Error creating stores: %v", err)
 		}
-		printSecrets(vaultClients)
+		printSecrets(stores)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(printCmd)
+
+	printCmd.Flags().BoolVar(&printShowKeys, "show-keys", false, "print the raw keys instead of their fingerprints")
+	printCmd.Flags().StringVarP(&printOutput, "output", "o", "table", "output format (table, json, yaml)")
+}
+
+// keyReport describes a key of a vault
+type keyReport struct {
+	Index       int    `json:"index" yaml:"index"`
+	Role        string `json:"role" yaml:"role"`
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"`
+	Key         string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// vaultReport describes the keys held by a vault
+type vaultReport struct {
+	Address      string      `json:"address" yaml:"address"`
+	Error        string      `json:"error,omitempty" yaml:"error,omitempty"`
+	CreationTime string      `json:"creation_time,omitempty" yaml:"creation_time,omitempty"`
+	Period       int64       `json:"period,omitempty" yaml:"period,omitempty"`
+	Age          int64       `json:"age,omitempty" yaml:"age,omitempty"`
+	NextRotation string      `json:"next_rotation,omitempty" yaml:"next_rotation,omitempty"`
+	Keys         []keyReport `json:"keys,omitempty" yaml:"keys,omitempty"`
+}
+
+// printReport describes the keys held by every vault
+type printReport struct {
+	Consistent bool          `json:"consistent" yaml:"consistent"`
+	Verdict    string        `json:"verdict" yaml:"verdict"`
+	Vaults     []vaultReport `json:"vaults" yaml:"vaults"`
+}
+
+func printSecrets(stores []locksmith.Store) {
+	switch printOutput {
+	case "table", "json", "yaml":
+	default:
+		log.Fatalf("Unknown output format %q", printOutput)
+	}
+	if printShowKeys {
+		log.Warn("PRINTING RAW FERNET KEYS: anyone who reads them can forge and decrypt keystone tokens. Do not paste this output in tickets, chats or logs")
+	}
+
+	report := newPrintReport(stores, time.Now())
+	switch printOutput {
+	case "json":
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("Cannot print keys: %v", err)
+		}
+		fmt.Println(string(b))
+	case "yaml":
+		b, err := yaml.Marshal(report)
+		if err != nil {
+			log.Fatalf("Cannot print keys: %v", err)
+		}
+		fmt.Print(string(b))
+	default:
+		printTable(report)
+	}
 }
 
-func printSecrets(vaultClients []*vault.Vault) {
-	vaultClients, err := createVaultClients()
-	if err != nil {
-		log.Fatalf("Error creating vault clients: %v", err)
+// newPrintReport reads the keys of every vault
+func newPrintReport(stores []locksmith.Store, now time.Time) *printReport {
+	report := &printReport{Consistent: true, Verdict: "consistent"}
+	if _, err := loadPolicy(); err != nil {
+		log.Errorf("Invalid schedule configuration, next rotations are not printed: %v", err)
 	}
-	for _, v := range vaultClients {
-		s, err := v.Read(cfg.SecretPath)
+	var ref *locksmith.FernetKeys
+	for _, v := range stores {
+		vr := vaultReport{Address: v.Name()}
+		fkeys, err := locksmith.ReadFernetKeys(v, cfg.SecretPath)
 		if err != nil {
-			log.Errorf("Error reading secret in %s: %v", v.Client.Address(), err)
+			log.Errorf("Error reading keys in %s: %v", v.Name(), err)
+			vr.Error = err.Error()
+			report.Consistent = false
+			report.Verdict = "unreadable"
+			report.Vaults = append(report.Vaults, vr)
+			continue
+		}
+
+		created := time.Unix(fkeys.CreationTime, 0)
+		vr.CreationTime = created.UTC().Format(time.RFC3339)
+		vr.Period = fkeys.Period
+		vr.Age = int64(now.Sub(created).Seconds())
+		if next, err := nextRotationTime(fkeys, cfg.TTL); err == nil {
+			vr.NextRotation = next.UTC().Format(time.RFC3339)
+		}
+		for i, k := range fkeys.Keys {
+			kr := keyReport{Index: i, Role: fkeys.Role(i), Fingerprint: locksmith.Fingerprint(k)}
+			if printShowKeys {
+				kr.Key = k
+			}
+			vr.Keys = append(vr.Keys, kr)
 		}
-		fmt.Printf("%s:\n%s", v.Client.Address(), s)
+		report.Vaults = append(report.Vaults, vr)
+
+		if ref == nil {
+			ref = fkeys
+		} else if !ref.Equal(fkeys) && report.Consistent {
+			report.Consistent = false
+			report.Verdict = "diverged"
+		}
+	}
+	return report
+}
+
+// printTable prints the report as tables
+func printTable(report *printReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VAULT\tCREATED\tPERIOD\tAGE\tNEXT ROTATION\tERROR")
+	for _, vr := range report.Vaults {
+		if vr.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t%s\n", vr.Address, vr.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n", vr.Address, vr.CreationTime,
+			time.Duration(vr.Period)*time.Second, time.Duration(vr.Age)*time.Second, vr.NextRotation)
+	}
+	w.Flush()
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if printShowKeys {
+		fmt.Fprintln(w, "VAULT\tINDEX\tROLE\tFINGERPRINT\tKEY")
+	} else {
+		fmt.Fprintln(w, "VAULT\tINDEX\tROLE\tFINGERPRINT")
+	}
+	for _, vr := range report.Vaults {
+		for _, kr := range vr.Keys {
+			if printShowKeys {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", vr.Address, kr.Index, kr.Role, kr.Fingerprint, kr.Key)
+			} else {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", vr.Address, kr.Index, kr.Role, kr.Fingerprint)
+			}
+		}
+	}
+	w.Flush()
+	fmt.Println()
+
+	switch report.Verdict {
+	case "consistent":
+		fmt.Println("Keys are identical in each vault")
+	case "diverged":
+		fmt.Println("Keys are NOT identical in each vault")
+	default:
+		fmt.Println("Keys could not be read from every vault")
 	}
 }
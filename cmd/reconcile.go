@@ -0,0 +1,121 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// reconcileCmd represents the reconcile command
+var reconcileCmd = &cobra.Command{
+	Use:         "reconcile",
+	Short:       "Repair Vault(s) holding keys different from the authoritative keys",
+	Annotations: supportsDryRun,
+	Long: `Select the authoritative keys among the Vault(s) and write them to the Vault(s) holding different keys.
+The authoritative keys are the keys of the first Vault (primary), the most recent keys (newest)
+or the keys held by a majority of Vaults (majority).
+Divergences that may be the result of tampering, like keys sharing no key with the authoritative keys,
+are refused unless explicitly allowed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		stores, err := createStores()
+		if err != nil {
+			log.Fatalf("Error creating stores: %v", err)
+		}
+		if cfg.DryRun {
+			planReconcile(stores)
+		}
+		if _, err := reconcile(stores, cfg.SecretPath, cfg.TTL); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Reconciliation done")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reconcileCmd)
+
+	reconcileCmd.Flags().String("reconcile-strategy", string(locksmith.StrategyPrimary), "how authoritative keys are selected when vaults diverge (primary, newest, majority)")
+	reconcileCmd.Flags().Bool("reconcile-allow-disjoint", false, "allow repairing keys that share no key with the authoritative keys")
+	reconcileCmd.Flags().Bool("reconcile-allow-newer", false, "allow repairing keys created after the authoritative keys")
+	reconcileCmd.Flags().Int("reconcile-max-divergence", 0, "maximum number of authoritative keys missing from repaired keys, 0 means no limit")
+
+	viper.BindPFlag("reconcile.strategy", reconcileCmd.Flags().Lookup("reconcile-strategy"))
+	viper.BindPFlag("reconcile.allowDisjoint", reconcileCmd.Flags().Lookup("reconcile-allow-disjoint"))
+	viper.BindPFlag("reconcile.allowNewer", reconcileCmd.Flags().Lookup("reconcile-allow-newer"))
+	viper.BindPFlag("reconcile.maxDivergence", reconcileCmd.Flags().Lookup("reconcile-max-divergence"))
+
+	// The watch command reconciles, and the diff command selects the authoritative keys,
+	// with the same options. They share the flags, as a key is only bound to one flag.
+	for _, name := range []string{"reconcile-strategy", "reconcile-allow-disjoint", "reconcile-allow-newer", "reconcile-max-divergence"} {
+		watchCmd.Flags().AddFlag(reconcileCmd.Flags().Lookup(name))
+	}
+	diffCmd.Flags().AddFlag(reconcileCmd.Flags().Lookup("reconcile-strategy"))
+}
+
+// reconcile repairs the vaults holding keys different from the authoritative keys
+// and returns the authoritative keys
+func reconcile(stores []locksmith.Store, path string, ttl int) (*locksmith.FernetKeys, error) {
+	fkeys, repaired, err := locksmith.Reconcile(stores, path, reconcileOptions(), ttl)
+	for _, name := range repaired {
+		log.Infof("Keys repaired in %s", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Reconciliation failed: %v", err)
+	}
+	if len(repaired) == 0 {
+		log.Info("Keys are identical in each vaults, nothing to reconcile")
+	}
+	return fkeys, nil
+}
+
+// planReconcile prints the plan of the reconciliation of the vaults and exits
+func planReconcile(stores []locksmith.Store) {
+	r, err := locksmith.DecideReconcile(stores, cfg.SecretPath, reconcileOptions())
+	if err != nil {
+		log.Fatalf("Reconciliation failed: %v", err)
+	}
+	lagging := make(map[int]bool, len(r.Lagging))
+	for _, i := range r.Lagging {
+		lagging[i] = true
+	}
+	plan := &locksmith.Plan{Operation: "reconcile", Path: cfg.SecretPath}
+	plan.Note(fmt.Sprintf("Authoritative keys are the keys of %s", stores[r.Source].Name()))
+	for i, v := range stores {
+		next := r.Keysets[i]
+		if lagging[i] {
+			next = r.Authoritative
+		}
+		plan.Add(v.Name(), r.Keysets[i], next)
+	}
+	exitWithPlan(plan)
+}
+
+// reconcileOptions returns the reconciliation options from the configuration
+func reconcileOptions() locksmith.ReconcileOptions {
+	return locksmith.ReconcileOptions{
+		Strategy: locksmith.Strategy(cfg.Reconcile.Strategy),
+		Policy: locksmith.SafetyPolicy{
+			AllowDisjoint: cfg.Reconcile.AllowDisjoint,
+			AllowNewer:    cfg.Reconcile.AllowNewer,
+			MaxDivergence: cfg.Reconcile.MaxDivergence,
+		},
+	}
+}
@@ -22,6 +22,7 @@ import (
 
 	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
 
+	vaultapi "github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -31,21 +32,60 @@ import (
 type Configuration struct {
 	Vault        VaultConfiguration // Configuration
 	Vaults       []VaultConfiguration
+	Stores       []StoreConfiguration // Stores holding the keys, after the vaults
 	Consul       ConsulConfiguration
-	TTL          int              // Interval between each poll on vault
-	SecretPath   string           // Path in vault for fernet-keys secret
-	Health       bool             // Enable health endpoint
-	HealthPeriod int              // Period between each health check in seconds
-	Bootstrap    BootstrapOptions // Options needed to bootstrap secrets
+	Lock         LockOptions         // Lock electing the watch instance rotating the keys
+	TTL          int                 // Interval between each poll on vault
+	SecretPath   string              // Path in vault for fernet-keys secret
+	Health       bool                // Enable health endpoint
+	Metrics      bool                // Enable prometheus metrics endpoint
+	Admin        AdminConfiguration  // Options of the admin server
+	HealthPeriod int                 // Period between each health check in seconds
+	Bootstrap    BootstrapOptions    // Options needed to bootstrap secrets
+	Reconcile    ReconcileOptions    // Options used to reconcile diverging vaults
+	Agent        AgentOptions        // Options of the keystone key repository agent
+	Hooks        []HookConfiguration // Commands and webhooks run when the keys change
+	Schedule     ScheduleOptions     // When the watch loop rotates keys
+	Kubernetes   KubernetesOptions   // Kubernetes secret the keys are written to
+	DryRun       bool                // Print the changes instead of making them
 }
 
 // VaultConfiguration holds all the options to create a vault client
 type VaultConfiguration struct {
-	Address    string // Vault address
-	Proxy      string // Path to proxy
-	Token      string // Vault token used to identify with this vault
-	TokenFile  string // Path to file containing vault token
-	RenewToken bool   // Enable token renewal
+	Address       string                 // Vault address
+	Proxy         string                 // Path to proxy
+	Token         string                 // Vault token used to identify with this vault
+	TokenFile     string                 // Path to file containing vault token
+	RenewToken    bool                   // Enable token renewal
+	Auth          VaultAuthConfiguration // Auth method used instead of a static token
+	CACert        string                 // Path to a PEM-encoded CA cert file used to verify the Vault server certificate
+	CAPath        string                 // Path to a directory of PEM-encoded CA cert files
+	ClientCert    string                 // Path to the PEM-encoded client certificate presented to Vault
+	ClientKey     string                 // Path to the PEM-encoded private key of the client certificate
+	TLSServerName string                 // Server name used for SNI and certificate verification
+	Namespace     string                 // Vault Enterprise namespace holding the secret
+}
+
+// VaultAuthConfiguration holds the options of the auth method used to log in to a vault
+type VaultAuthConfiguration struct {
+	Method       string // Auth method (approle, kubernetes, cert)
+	Mount        string // Mount path of the auth method. Defaults to the method name
+	RoleID       string // AppRole role ID
+	SecretID     string // AppRole secret ID
+	SecretIDFile string // Path to file containing the AppRole secret ID
+	Role         string // Kubernetes auth role
+	JWTFile      string // Path to the Kubernetes service account token
+	Name         string // Certificate role name
+}
+
+// StoreConfiguration holds the options of a store holding the keys.
+// Vault and consul stores use the options of a vault configuration.
+type StoreConfiguration struct {
+	Type               string // Backend of the store (vault, file, consul)
+	VaultConfiguration `mapstructure:",squash"`
+	Directory          string // Directory of a file store
+	KeyFile            string // Path to file containing the base64 encoded key encrypting a file or consul store
+	Prefix             string // Prefix of the keys of a consul store
 }
 
 // ConsulConfiguration holds all the options to create a vault client
@@ -58,12 +98,94 @@ type ConsulConfiguration struct {
 	LockKey   string // What key is used for the consul lock system
 }
 
+// LockOptions holds the options of the lock electing the watch instance rotating the keys
+type LockOptions struct {
+	Backend       string // Backend of the lock (consul, kubernetes, vault). consul.lock enables the consul lock when empty
+	Name          string // Name of the Kubernetes lease
+	Namespace     string // Namespace of the lease, the namespace of the pod or of the context when empty
+	Path          string // Path of the vault lock document, the secret path followed by .lock when empty
+	Identity      string // Identity of this instance, the hostname followed by a random suffix when empty
+	LeaseDuration int    // Time in seconds other instances wait before taking over a lease or vault lock that is not renewed
+	RenewDeadline int    // Time in seconds the holder tries to renew the lease before considering it lost
+	RetryPeriod   int    // Interval in seconds between attempts to acquire or renew the lease
+}
+
+// AdminConfiguration holds the options of the admin http server
+type AdminConfiguration struct {
+	Enabled   bool   // Enable the admin server. It is also enabled by health or metrics
+	Address   string // Listen address
+	TLSCert   string // Path to the PEM-encoded server certificate
+	TLSKey    string // Path to the PEM-encoded server key
+	ClientCA  string // Path to the PEM-encoded CA used to verify client certificates
+	Token     string // Bearer token required by the admin API
+	TokenFile string // Path to file containing the bearer token of the admin API
+}
+
 // BootstrapOptions holds the extra options needed to bootstrap fernet keys
 type BootstrapOptions struct {
 	NumKeys int   // Number of fernet keys to create
 	Period  int64 // Period between each key rotation
 }
 
+// ReconcileOptions holds the options used to reconcile vaults holding different keys
+type ReconcileOptions struct {
+	Enabled       bool   // Reconcile vaults automatically in the watch loop
+	Strategy      string // How authoritative keys are selected (primary, newest, majority)
+	AllowDisjoint bool   // Repair keys that share no key with the authoritative keys
+	AllowNewer    bool   // Repair keys created after the authoritative keys
+	MaxDivergence int    // Maximum number of authoritative keys missing from repaired keys, 0 means no limit
+}
+
+// AgentOptions holds the options used to write keys to a keystone key repository
+type AgentOptions struct {
+	KeyRepository string // Keystone fernet key repository
+	Owner         string // User owning the key files
+	Group         string // Group owning the key files
+	Mode          string // Mode of the key files, in octal
+	ReloadCommand string // Command run after the keys changed
+}
+
+// ScheduleOptions holds the options deciding when the watch loop rotates keys
+type ScheduleOptions struct {
+	Rotation    string                  // Cron expression or "daily at HH:MM in Zone". Keys are rotated after their period if empty
+	Timezone    string                  // Time zone of cron expressions, UTC by default
+	Blackouts   []BlackoutConfiguration // Windows during which rotations are deferred
+	MaxDeferral int                     // Maximum time a rotation can be deferred in seconds, 0 means no limit
+	MaxAge      int                     // Maximum age of the keys in seconds, 0 means no limit
+}
+
+// KubernetesOptions holds the options used to write the keys to a Kubernetes secret
+type KubernetesOptions struct {
+	Kubeconfig string // Path to a kubeconfig file. The service account of the pod is used when empty
+	Context    string // Context of the kubeconfig, the current context when empty
+	Secret     string // Name of the secret the keys are written to after each rotation. Nothing is written when empty
+	Namespace  string // Namespace of the secret, the namespace of the pod or of the context when empty
+}
+
+// BlackoutConfiguration holds a window during which rotations are deferred,
+// either recurring (start and duration) or single (from and to)
+type BlackoutConfiguration struct {
+	Start    string // Schedule of the start of a recurring window
+	Duration int    // Duration of a recurring window in seconds
+	From     string // Start of a single window, in RFC 3339 format
+	To       string // End of a single window, in RFC 3339 format
+}
+
+// HookConfiguration holds the options of a command or webhook run when the keys change
+type HookConfiguration struct {
+	Name          string   // Name of the hook, used in logs
+	Events        []string // Events triggering the hook (pre-rotation, rotation, bootstrap, delete)
+	Command       []string // Command executed with the keys metadata as JSON on stdin and in the environment
+	URL           string   // URL the keys metadata is posted to
+	Secret        string   // Secret used to sign webhook payloads with HMAC-SHA256
+	SecretFile    string   // Path to file containing the webhook secret
+	Timeout       int      // Timeout of each attempt in seconds
+	Retries       int      // Number of retries after a failed attempt
+	RetryInterval int      // Interval between attempts in seconds
+	IncludeKeys   bool     // Send the raw keys to the hook
+	Veto          bool     // A failure of this pre-rotation hook aborts the rotation
+}
+
 var (
 	cfgFile string
 	cfg     Configuration
@@ -80,7 +202,8 @@ Keys are URL-safe base64 encoded strings made from 256 bits of pseudorandom data
 		if err := setUpLogs(viper.GetString("verbosity")); err != nil {
 			log.Fatalf("Cannot set up log levels: %v", err)
 		}
-		log.Debugf("Configuration used: %v", viper.AllSettings())
+		log.Debugf("Configuration used: %v", redactSettings(viper.AllSettings(), ""))
+		checkDryRun(cmd)
 	},
 }
 
@@ -101,14 +224,28 @@ func init() {
 	rootCmd.PersistentFlags().String("vault-proxy", "", "proxy URL used to contact Vault")
 	rootCmd.PersistentFlags().String("vault-token", "", "Vault token used to authenticate with Vault")
 	rootCmd.PersistentFlags().String("vault-token-file", "", "file containing the vault token used to authenticate with Vault")
+	rootCmd.PersistentFlags().String("vault-ca-cert", "", "PEM-encoded CA cert file used to verify the Vault server certificate")
+	rootCmd.PersistentFlags().String("vault-ca-path", "", "directory of PEM-encoded CA cert files used to verify the Vault server certificate")
+	rootCmd.PersistentFlags().String("vault-client-cert", "", "PEM-encoded client certificate presented to Vault")
+	rootCmd.PersistentFlags().String("vault-client-key", "", "PEM-encoded private key of the client certificate")
+	rootCmd.PersistentFlags().String("vault-tls-server-name", "", "server name used for SNI when connecting to Vault")
+	rootCmd.PersistentFlags().String("vault-namespace", "", "Vault Enterprise namespace holding the secret")
 	rootCmd.PersistentFlags().String("secret-path", "secret/fernet-keys", "path to the fernet-keys secret in primary Vault")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "print the changes to the keys instead of making them. Exits with 2 if the keys would change")
 	rootCmd.PersistentFlags().StringP("verbosity", "v", log.InfoLevel.String(), "log level (debug, info, warn, error, fatal, panic)")
 
 	viper.BindPFlag("vault.address", rootCmd.PersistentFlags().Lookup("vault-address"))
 	viper.BindPFlag("vault.proxy", rootCmd.PersistentFlags().Lookup("vault-proxy"))
 	viper.BindPFlag("vault.token", rootCmd.PersistentFlags().Lookup("vault-token"))
 	viper.BindPFlag("vault.tokenFile", rootCmd.PersistentFlags().Lookup("vault-token-file"))
+	viper.BindPFlag("vault.caCert", rootCmd.PersistentFlags().Lookup("vault-ca-cert"))
+	viper.BindPFlag("vault.caPath", rootCmd.PersistentFlags().Lookup("vault-ca-path"))
+	viper.BindPFlag("vault.clientCert", rootCmd.PersistentFlags().Lookup("vault-client-cert"))
+	viper.BindPFlag("vault.clientKey", rootCmd.PersistentFlags().Lookup("vault-client-key"))
+	viper.BindPFlag("vault.tlsServerName", rootCmd.PersistentFlags().Lookup("vault-tls-server-name"))
+	viper.BindPFlag("vault.namespace", rootCmd.PersistentFlags().Lookup("vault-namespace"))
 	viper.BindPFlag("secretPath", rootCmd.PersistentFlags().Lookup("secret-path"))
+	viper.BindPFlag("dryRun", rootCmd.PersistentFlags().Lookup("dry-run"))
 	viper.BindPFlag("verbosity", rootCmd.PersistentFlags().Lookup("verbosity"))
 }
 
@@ -132,40 +269,81 @@ func initConfig() {
 	}
 }
 
-// createVaultClients create a list of Vault clients. It Makes sure we can contact
-// every Vaults
-func createVaultClients() ([]*vault.Vault, error) {
-	var vaultConfigs []VaultConfiguration
-	var vcs []*vault.Vault
-	if len(cfg.Vaults) != 0 {
-		vaultConfigs = cfg.Vaults
-	} else {
-		vaultConfigs = []VaultConfiguration{cfg.Vault}
+// createVaultClient creates a Vault client and logs in
+func createVaultClient(vaultConfig VaultConfiguration) *vault.Vault {
+	if vaultConfig.Auth.Method == "cert" && vaultConfig.ClientCert == "" {
+		log.Fatalf("Auth method cert requires a client certificate for Vault %s", vaultConfig.Address)
 	}
-	log.Debug("Creating Vault clients")
-	for _, vaultConfig := range vaultConfigs {
-		vaultClient, err := vault.NewClient(vaultConfig.Address, vaultConfig.Proxy, vaultConfig.RenewToken)
-		if err != nil {
-			log.Fatalf("Failed to create vault client for %s: %v", vaultConfig.Address, err)
+	tlsConfig := &vaultapi.TLSConfig{
+		CACert:        vaultConfig.CACert,
+		CAPath:        vaultConfig.CAPath,
+		ClientCert:    vaultConfig.ClientCert,
+		ClientKey:     vaultConfig.ClientKey,
+		TLSServerName: vaultConfig.TLSServerName,
+	}
+	vaultClient, err := vault.NewClient(vaultConfig.Address, vaultConfig.Proxy, tlsConfig, vaultConfig.RenewToken)
+	if err != nil {
+		log.Fatalf("Failed to create vault client for %s: %v", vaultConfig.Address, err)
+	}
+	vaultClient.SetNamespace(vaultConfig.Namespace)
+	instrumentVault(vaultClient)
+
+	auth, err := vaultAuthenticator(vaultConfig.Auth)
+	if err != nil {
+		log.Fatalf("Invalid auth configuration for Vault %s: %v", vaultConfig.Address, err)
+	}
+	if auth != nil {
+		vaultClient.Auth = auth
+		if err := vaultClient.Login(); err != nil {
+			log.Fatalf("%v", err)
 		}
+		return vaultClient
+	}
 
-		// Set Vault client token
-		var vaultToken string
-		if vaultConfig.Token != "" {
-			vaultToken = vaultConfig.Token
-		} else if vaultConfig.TokenFile != "" {
-			data, err := ioutil.ReadFile(vaultConfig.TokenFile)
-			if err != nil {
-				log.Fatalf("Cannot read vault token file: %v", err)
-			}
-			vaultToken = string(data)
-		} else {
-			log.Fatalf("No vault token provided for Vault %s", vaultClient.Client.Address())
+	// Set Vault client token
+	var vaultToken string
+	if vaultConfig.Token != "" {
+		vaultToken = vaultConfig.Token
+	} else if vaultConfig.TokenFile != "" {
+		data, err := ioutil.ReadFile(vaultConfig.TokenFile)
+		if err != nil {
+			log.Fatalf("Cannot read vault token file: %v", err)
 		}
-		vaultClient.Client.SetToken(vaultToken)
-		vcs = append(vcs, vaultClient)
+		vaultToken = string(data)
+	} else {
+		log.Fatalf("No vault token provided for Vault %s", vaultClient.Name())
+	}
+	vaultClient.Client.SetToken(vaultToken)
+	return vaultClient
+}
+
+// vaultAuthenticator returns the vault auth method matching the configuration.
+// It returns nil if no auth method is configured.
+func vaultAuthenticator(c VaultAuthConfiguration) (vault.Authenticator, error) {
+	switch c.Method {
+	case "":
+		return nil, nil
+	case "approle":
+		return &vault.AppRoleAuth{
+			Mount:        c.Mount,
+			RoleID:       c.RoleID,
+			SecretID:     c.SecretID,
+			SecretIDFile: c.SecretIDFile,
+		}, nil
+	case "kubernetes":
+		return &vault.KubernetesAuth{
+			Mount:   c.Mount,
+			Role:    c.Role,
+			JWTFile: c.JWTFile,
+		}, nil
+	case "cert":
+		return &vault.CertAuth{
+			Mount: c.Mount,
+			Name:  c.Name,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth method %q", c.Method)
 	}
-	return vcs, nil
 }
 
 //setUpLogs set the log output and the log level
@@ -177,3 +355,46 @@ func setUpLogs(level string) error {
 	log.SetLevel(lvl)
 	return nil
 }
+
+// credentialSettings are the configuration keys holding credentials, masked in the logs
+var credentialSettings = map[string]bool{"token": true, "secretid": true, "secret": true}
+
+// redactSettings returns a copy of the settings where the values of credentials are masked.
+// kubernetes.secret is the name of a Kubernetes secret and is not masked.
+func redactSettings(v interface{}, path string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			redacted[k] = redactSetting(k, e, path)
+		}
+		return redacted
+	case map[interface{}]interface{}:
+		redacted := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			redacted[k] = redactSetting(fmt.Sprint(k), e, path)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, e := range v {
+			redacted[i] = redactSettings(e, path)
+		}
+		return redacted
+	default:
+		return v
+	}
+}
+
+// redactSetting masks the value of the setting key under path if it holds a credential
+func redactSetting(key string, v interface{}, path string) interface{} {
+	key = strings.ToLower(key)
+	if path != "" {
+		key = path + "." + key
+	}
+	name := key[strings.LastIndex(key, ".")+1:]
+	if credentialSettings[name] && key != "kubernetes.secret" && fmt.Sprint(v) != "" {
+		return "<redacted>"
+	}
+	return redactSettings(v, key)
+}
@@ -16,7 +16,6 @@ package cmd
 
 import (
 	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
-	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -26,14 +25,15 @@ var rotateCmdPeriod int64
 
 // rotateCmd represents the rotate command
 var rotateCmd = &cobra.Command{
-	Use:   "rotate",
-	Short: "Force a fernet keys rotation",
+	Use:         "rotate",
+	Short:       "Force a fernet keys rotation",
+	Annotations: supportsDryRun,
 	Run: func(cmd *cobra.Command, args []string) {
-		vaultClients, err := createVaultClients()
+		stores, err := createStores()
 		if err != nil {
-			log.Fatalf("Error creating vault clients: %v", err)
+			log.Fatalf("Error creating stores: %v", err)
 		}
-		rotate(vaultClients)
+		rotate(stores)
 	},
 }
 
@@ -43,23 +43,63 @@ func init() {
 	rotateCmd.Flags().Int64VarP(&rotateCmdPeriod, "period", "p", 0, "period between each key rotation. Do not change the period if it is 0")
 }
 
-func rotate(vaultClients []*vault.Vault) {
-	fkeys, err := locksmith.GetFernetKeys(vaultClients, cfg.SecretPath)
+func rotate(stores []locksmith.Store) {
+	checkHooks()
+	checkSink()
+
+	fkeys, err := locksmith.GetFernetKeys(stores, cfg.SecretPath)
 	if err != nil {
 		log.Fatalf("Cannot rotate keys: %v", err)
 	}
 
-	if err := fkeys.Rotate(rotateCmdPeriod); err != nil {
+	if cfg.DryRun {
+		planRotation(stores, fkeys, rotateCmdPeriod)
+	}
+
+	if err := rotateFernetKeys(stores, cfg.SecretPath, fkeys, rotateCmdPeriod, cfg.TTL); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// planRotation prints the plan of the rotation of fkeys and exits
+func planRotation(stores []locksmith.Store, fkeys *locksmith.FernetKeys, period int64) {
+	next := fkeys.Copy()
+	if err := next.Rotate(period); err != nil {
 		log.Fatalf("Error rotating keys: %v", err)
 	}
+	plan := &locksmith.Plan{Operation: "rotate", Path: cfg.SecretPath}
+	for _, v := range stores {
+		plan.Add(v.Name(), fkeys, next)
+	}
+	if hs, _ := loadHooks(); len(hs) != 0 {
+		plan.Note("Hooks are not run in dry run")
+	}
+	if sink, _ := loadSink(); sink != nil {
+		plan.Note("Keys are not written to " + sink.String() + " in dry run")
+	}
+	exitWithPlan(plan)
+}
 
-	for _, v := range vaultClients {
-		vaultName := v.Client.Address()
-		log.Infof("Writing keys to %s", vaultName)
-		if err := locksmith.WriteFernetKeys(v, cfg.SecretPath, fkeys, cfg.TTL); err != nil {
-			log.Fatalf("Cannot write fernet keys to %s : %v", vaultName, err)
+// logRotationError logs the state each Vault ended up in after a failed rotation
+func logRotationError(err error) {
+	rerr, ok := err.(*locksmith.RotationError)
+	if !ok {
+		log.Error(err)
+		return
+	}
+	log.Error(rerr.Err)
+	for _, r := range rerr.Results {
+		l := log.WithField("vault", r.Vault).WithField("state", r.State.String())
+		if r.Err != nil {
+			l = l.WithError(r.Err)
+		}
+		if r.State == locksmith.StateUnknown {
+			l.Error("Vault may hold the new keys")
+		} else {
+			l.Warn("Vault state after failed rotation")
 		}
-		log.Debugf("Keys written to %s", vaultName)
 	}
-	log.Info("Rotation complete")
+	if !rerr.Consistent() {
+		log.Error("Vaults are not consistent anymore and need to be reconciled")
+	}
 }
@@ -0,0 +1,135 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/aevox/vault-fernet-locksmith/pkg/schedule"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	policyOnce     sync.Once
+	policy         *schedule.Policy
+	errScheduleCfg error
+)
+
+// loadPolicy returns the rotation policy of the configuration
+func loadPolicy() (*schedule.Policy, error) {
+	policyOnce.Do(func() {
+		policy, errScheduleCfg = newPolicy(cfg.Schedule)
+	})
+	return policy, errScheduleCfg
+}
+
+// newPolicy creates the rotation policy described by the schedule options
+func newPolicy(o ScheduleOptions) (*schedule.Policy, error) {
+	loc := time.UTC
+	if o.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(o.Timezone); err != nil {
+			return nil, fmt.Errorf("Invalid time zone: %v", err)
+		}
+	}
+	if o.MaxDeferral < 0 || o.MaxAge < 0 {
+		return nil, errors.New("Maximum deferral and age must be positive")
+	}
+
+	p := &schedule.Policy{
+		MaxDeferral: time.Duration(o.MaxDeferral) * time.Second,
+		MaxAge:      time.Duration(o.MaxAge) * time.Second,
+	}
+	if o.Rotation != "" {
+		s, err := schedule.Parse(o.Rotation, loc)
+		if err != nil {
+			return nil, err
+		}
+		p.Schedule = s
+	}
+
+	for i, b := range o.Blackouts {
+		var w schedule.Window
+		switch {
+		case b.Start != "" && b.From == "" && b.To == "":
+			s, err := schedule.Parse(b.Start, loc)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid blackout window #%d: %v", i, err)
+			}
+			if b.Duration <= 0 {
+				return nil, fmt.Errorf("Blackout window #%d must have a positive duration", i)
+			}
+			w.Start = s
+			w.Duration = time.Duration(b.Duration) * time.Second
+			if w.Overlaps(time.Now()) {
+				return nil, fmt.Errorf("Blackout window #%d must be shorter than the time between two of its starts", i)
+			}
+		case b.Start == "" && b.From != "" && b.To != "":
+			var err error
+			if w.From, err = time.Parse(time.RFC3339, b.From); err != nil {
+				return nil, fmt.Errorf("Invalid blackout window #%d: %v", i, err)
+			}
+			if w.To, err = time.Parse(time.RFC3339, b.To); err != nil {
+				return nil, fmt.Errorf("Invalid blackout window #%d: %v", i, err)
+			}
+			if !w.To.After(w.From) {
+				return nil, fmt.Errorf("Blackout window #%d ends before it starts", i)
+			}
+		default:
+			return nil, fmt.Errorf("Blackout window #%d must have either a start and a duration, or from and to", i)
+		}
+		p.Blackouts = append(p.Blackouts, w)
+	}
+	return p, nil
+}
+
+// checkSchedule exits if the schedule is misconfigured
+func checkSchedule() {
+	if _, err := loadPolicy(); err != nil {
+		log.Fatalf("Invalid schedule configuration: %v", err)
+	}
+}
+
+// decideRotation tells whether fkeys must be rotated now by the watch loop
+func decideRotation(fkeys *locksmith.FernetKeys, ttl int) (schedule.Decision, error) {
+	p, err := loadPolicy()
+	if err != nil {
+		return schedule.Decision{}, fmt.Errorf("Invalid schedule configuration: %v", err)
+	}
+	return p.Decide(
+		time.Unix(fkeys.CreationTime, 0),
+		time.Duration(fkeys.Period)*time.Second,
+		time.Duration(ttl)*time.Second,
+		time.Now(),
+	), nil
+}
+
+// nextRotationTime returns the time fkeys are due for rotation
+func nextRotationTime(fkeys *locksmith.FernetKeys, ttl int) (time.Time, error) {
+	p, err := loadPolicy()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid schedule configuration: %v", err)
+	}
+	return p.Due(
+		time.Unix(fkeys.CreationTime, 0),
+		time.Duration(fkeys.Period)*time.Second,
+		time.Duration(ttl)*time.Second,
+	), nil
+}
@@ -0,0 +1,83 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"sync"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/kubernetes"
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	sinkOnce   sync.Once
+	secretSink *kubernetes.SecretSink
+	errSinkCfg error
+)
+
+// loadSink returns the Kubernetes secret the keys are written to, nil if none is configured
+func loadSink() (*kubernetes.SecretSink, error) {
+	sinkOnce.Do(func() {
+		if cfg.Kubernetes.Secret == "" {
+			return
+		}
+		var c *kubernetes.Client
+		if c, errSinkCfg = newKubernetesClient(); errSinkCfg != nil {
+			return
+		}
+		secretSink = &kubernetes.SecretSink{
+			Client:    c,
+			Namespace: cfg.Kubernetes.Namespace,
+			Name:      cfg.Kubernetes.Secret,
+			ManagedBy: "vault-fernet-locksmith",
+		}
+	})
+	return secretSink, errSinkCfg
+}
+
+// newKubernetesClient creates a client of the Kubernetes API with the kubeconfig
+// of the configuration, or the service account of the pod
+func newKubernetesClient() (*kubernetes.Client, error) {
+	log.Debug("Creating Kubernetes client")
+	return kubernetes.NewClientFromConfig(cfg.Kubernetes.Kubeconfig, cfg.Kubernetes.Context)
+}
+
+// checkSink exits if the Kubernetes secret is misconfigured
+func checkSink() {
+	if _, err := loadSink(); err != nil {
+		log.Fatalf("Invalid Kubernetes configuration: %v", err)
+	}
+}
+
+// writeSink writes fkeys to the Kubernetes secret, if one is configured.
+// Failures are only logged: the keys are already committed to the stores, and
+// the watch loop writes them again.
+func writeSink(fkeys *locksmith.FernetKeys) {
+	sink, err := loadSink()
+	if sink == nil || err != nil {
+		return
+	}
+	changed, err := sink.Write(fkeys.Keys)
+	if err != nil {
+		sinkFailures.Inc()
+		log.Errorf("Cannot write keys to %s: %v", sink, err)
+		return
+	}
+	if changed {
+		log.Infof("Keys written to %s, primary key %s", sink, fkeys.PrimaryFingerprint())
+	}
+}
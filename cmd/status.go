@@ -0,0 +1,257 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Status levels, with the exit codes of monitoring plugins
+const (
+	statusOK       = 0
+	statusWarning  = 1
+	statusCritical = 2
+	statusUnknown  = 3
+)
+
+var statusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+var (
+	statusOutput        string
+	statusMaxAge        int64
+	statusWarningMargin int64
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:         "status",
+	Short:       "Check the fernet keys in Vault(s) and report OK, WARNING or CRITICAL",
+	Annotations: supportsDryRun,
+	Long: `Check the fernet keys in Vault(s), like a monitoring plugin.
+The exit code is 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN, the check could not run).
+WARNING: keys past their rotation time, keys approaching their maximum age, or a lock not held by any instance.
+CRITICAL: Vaults holding different keys, unreadable Vaults, malformed keys, keys older than their maximum age,
+or an invalid schedule configuration.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// Errors preventing the check from running are UNKNOWN, not WARNING
+		log.StandardLogger().ExitFunc = func(int) { os.Exit(statusUnknown) }
+
+		stores, err := createStores()
+		if err != nil {
+			log.Fatalf("Error creating stores: %v", err)
+		}
+		status(stores)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().StringVarP(&statusOutput, "output", "o", "text", "output format (text, json)")
+	statusCmd.Flags().Int64Var(&statusMaxAge, "max-age", 0, "maximum age of the keys in seconds. Defaults to schedule.maxAge, 0 disables the check")
+	statusCmd.Flags().Int64Var(&statusWarningMargin, "warning-margin", 3600, "warn when the keys are less than this many seconds away from their maximum age")
+}
+
+// statusCheck is the result of one check
+type statusCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	level   int
+}
+
+// statusReport is the result of every check
+type statusReport struct {
+	Status       string        `json:"status"`
+	Primary      string        `json:"primary,omitempty"`
+	CreationTime string        `json:"creation_time,omitempty"`
+	Age          int64         `json:"age,omitempty"`
+	NextRotation string        `json:"next_rotation,omitempty"`
+	Checks       []statusCheck `json:"checks"`
+	level        int
+}
+
+// add records the result of a check
+func (r *statusReport) add(name string, level int, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, statusCheck{
+		Name:    name,
+		Status:  statusNames[level],
+		Message: fmt.Sprintf(format, args...),
+		level:   level,
+	})
+	if level > r.level {
+		r.level = level
+	}
+	r.Status = statusNames[r.level]
+}
+
+func status(stores []locksmith.Store) {
+	if statusOutput != "text" && statusOutput != "json" {
+		log.Fatalf("Unknown output format %q", statusOutput)
+	}
+	report := &statusReport{Status: statusNames[statusOK]}
+	if _, err := loadPolicy(); err != nil {
+		report.add("schedule", statusCritical, "Invalid schedule configuration: %v", err)
+	}
+	if fkeys := checkVaults(report, stores); fkeys != nil {
+		checkKeysAge(report, fkeys, time.Now())
+	}
+	if lockBackend() != "" {
+		checkLock(report, stores)
+	}
+
+	if statusOutput == "json" {
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Fatalf("Cannot print status: %v", err)
+		}
+		fmt.Println(string(b))
+	} else {
+		printStatus(report)
+	}
+	os.Exit(report.level)
+}
+
+// checkVaults checks that every vault can be read and holds the same well-formed keys.
+// It returns the keys if they do. Each vault is read once, so that every check is
+// done on the same keys.
+func checkVaults(report *statusReport, stores []locksmith.Store) *locksmith.FernetKeys {
+	healthy, consistent := true, true
+	var fkeys *locksmith.FernetKeys
+	for _, v := range stores {
+		s, err := v.Read(cfg.SecretPath)
+		if err != nil {
+			report.add("vault", statusCritical, "Cannot read %s: %v", v.Name(), err)
+			healthy = false
+			continue
+		}
+		if s == nil {
+			report.add("vault", statusCritical, "No keys in %s", v.Name())
+			healthy = false
+			continue
+		}
+		keys, err := locksmith.DecodeFernetKeys(s)
+		if err != nil {
+			report.add("keys", statusCritical, "Malformed keys in %s: %v", v.Name(), err)
+			healthy = false
+			continue
+		}
+		if fkeys == nil {
+			fkeys = keys
+		} else if !fkeys.Equal(keys) {
+			consistent = false
+		}
+	}
+	if !healthy {
+		return nil
+	}
+	if !consistent {
+		report.add("consistency", statusCritical, "Keys are not identical in each vault")
+		return nil
+	}
+	report.add("consistency", statusOK, "Keys are identical in %d vault(s)", len(stores))
+
+	report.Primary = fkeys.PrimaryFingerprint()
+	report.CreationTime = time.Unix(fkeys.CreationTime, 0).UTC().Format(time.RFC3339)
+	if next, err := nextRotationTime(fkeys, cfg.TTL); err == nil {
+		report.NextRotation = next.UTC().Format(time.RFC3339)
+	}
+	return fkeys
+}
+
+// checkKeysAge checks that the keys were rotated in time and are not too old
+func checkKeysAge(report *statusReport, fkeys *locksmith.FernetKeys, now time.Time) {
+	created := time.Unix(fkeys.CreationTime, 0)
+	age := now.Sub(created)
+	report.Age = int64(age.Seconds())
+
+	// The watch loop rotates keys within a TTL of their rotation time
+	ttl := time.Duration(cfg.TTL) * time.Second
+	d, err := decideRotation(fkeys, cfg.TTL)
+	switch {
+	case err != nil:
+		// Reported by the schedule check
+	case d.Rotate && now.Sub(d.Due) > ttl:
+		report.add("rotation", statusWarning, "Keys are past their rotation time %s", d.Due.UTC().Format(time.RFC3339))
+	case !d.Deferred.IsZero():
+		report.add("rotation", statusOK, "Rotation deferred to %s by a blackout window", d.Deferred.UTC().Format(time.RFC3339))
+	default:
+		report.add("rotation", statusOK, "Next rotation at %s", d.Due.UTC().Format(time.RFC3339))
+	}
+
+	maxAge := time.Duration(statusMaxAge) * time.Second
+	if maxAge == 0 {
+		maxAge = time.Duration(cfg.Schedule.MaxAge) * time.Second
+	}
+	if maxAge <= 0 {
+		return
+	}
+	margin := time.Duration(statusWarningMargin) * time.Second
+	switch {
+	case age >= maxAge:
+		report.add("age", statusCritical, "Keys are %s old, more than their maximum age %s", age.Truncate(time.Second), maxAge)
+	case age >= maxAge-margin:
+		report.add("age", statusWarning, "Keys are %s old, approaching their maximum age %s", age.Truncate(time.Second), maxAge)
+	default:
+		report.add("age", statusOK, "Keys are %s old", age.Truncate(time.Second))
+	}
+}
+
+// checkLock checks that an instance of the watch command holds the lock
+func checkLock(report *statusReport, stores []locksmith.Store) {
+	locker, err := newLocker(stores)
+	if err != nil {
+		report.add("lock", statusWarning, "%v", err)
+		return
+	}
+	holder, err := locker.Holder()
+	if err != nil {
+		report.add("lock", statusWarning, "%v", err)
+		return
+	}
+	if holder == "" {
+		report.add("lock", statusWarning, "Lock %s is not held by any instance", locker.Name())
+		return
+	}
+	report.add("lock", statusOK, "Lock %s is held by %s", locker.Name(), holder)
+}
+
+// printStatus prints the report as a monitoring plugin output: a summary line
+// followed by the result of each check
+func printStatus(report *statusReport) {
+	var problems []string
+	for _, c := range report.Checks {
+		if c.level != statusOK {
+			problems = append(problems, c.Message)
+		}
+	}
+	summary := strings.Join(problems, ", ")
+	if summary == "" {
+		summary = fmt.Sprintf("primary key %s, next rotation at %s", report.Primary, report.NextRotation)
+	}
+	fmt.Printf("LOCKSMITH %s - %s\n", report.Status, summary)
+	for _, c := range report.Checks {
+		fmt.Printf("%s: %s: %s\n", c.Status, c.Name, c.Message)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/consul"
+	"github.com/aevox/vault-fernet-locksmith/pkg/filestore"
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/aevox/vault-fernet-locksmith/pkg/seal"
+	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// createStores creates the list of stores holding the keys. It makes sure we can
+// contact every store.
+// Vaults come first, then the stores of the stores section. The vault options are
+// ignored when the stores section is set.
+func createStores() ([]locksmith.Store, error) {
+	var vaultConfigs []VaultConfiguration
+	if len(cfg.Vaults) != 0 {
+		vaultConfigs = cfg.Vaults
+	} else if len(cfg.Stores) == 0 {
+		vaultConfigs = []VaultConfiguration{cfg.Vault}
+	}
+
+	var stores []locksmith.Store
+	log.Debug("Creating Vault clients")
+	for _, vaultConfig := range vaultConfigs {
+		stores = append(stores, createVaultClient(vaultConfig))
+	}
+	for i, storeConfig := range cfg.Stores {
+		s, err := newStore(storeConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot create store #%d: %v", i, err)
+		}
+		stores = append(stores, s)
+	}
+	return stores, nil
+}
+
+// newStore creates the store described by the configuration
+func newStore(c StoreConfiguration) (locksmith.Store, error) {
+	switch c.Type {
+	case "vault", "":
+		return createVaultClient(c.VaultConfiguration), nil
+	case "file":
+		if c.KeyFile == "" {
+			return nil, fmt.Errorf("File store %s requires a key file", c.Directory)
+		}
+		key, err := seal.ReadKeyFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Creating file store %s", c.Directory)
+		return filestore.New(c.Directory, key)
+	case "consul":
+		if c.KeyFile == "" {
+			return nil, fmt.Errorf("Consul store %s requires a key file", c.Address)
+		}
+		kek, err := seal.ReadKeyFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		token, err := storeToken(c.VaultConfiguration)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Creating consul store %s", c.Address)
+		consulClient, err := consul.NewClient(c.Address, c.Proxy, token)
+		if err != nil {
+			return nil, err
+		}
+		return consul.NewStore(consulClient, c.Prefix, kek)
+	default:
+		return nil, fmt.Errorf("Unknown store type %q", c.Type)
+	}
+}
+
+// storeToken returns the token used to authenticate with a store
+func storeToken(c VaultConfiguration) (string, error) {
+	if c.Token != "" {
+		return c.Token, nil
+	}
+	if c.TokenFile != "" {
+		data, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("Cannot read token file: %v", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+// storeWatcher returns the first store able to notify the changes of the keys, if any
+func storeWatcher(stores []locksmith.Store) (locksmith.Watcher, string) {
+	for _, s := range stores {
+		if w, ok := s.(locksmith.Watcher); ok {
+			return w, s.Name()
+		}
+	}
+	return nil, ""
+}
+
+// vaultClients returns the stores that are vaults
+func vaultClients(stores []locksmith.Store) []*vault.Vault {
+	var vcs []*vault.Vault
+	for _, s := range stores {
+		if v, ok := s.(*vault.Vault); ok {
+			vcs = append(vcs, v)
+		}
+	}
+	return vcs
+}
@@ -0,0 +1,158 @@
+// Copyright © 2019 Marc Fouché
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var syncYes bool
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:         "sync",
+	Short:       "Copy the fernet keys of the primary Vault to the secondary Vault(s)",
+	Annotations: supportsDryRun,
+	Long: `Read the fernet keys in the primary Vault (the first Vault of the configuration) and write them
+to the secondary Vaults. Use it to add a new Vault without bootstrapping new keys, which would invalidate every token.
+A preview of the changes is printed before writing. Secondary Vaults holding keys newer than the primary keys
+are never overwritten.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		stores, err := createStores()
+		if err != nil {
+			log.Fatalf("Error creating stores: %v", err)
+		}
+		syncSecrets(stores)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().BoolVarP(&syncYes, "yes", "y", false, "do not ask for confirmation")
+}
+
+// syncAction is what sync does to a secondary vault
+type syncAction struct {
+	vault   locksmith.Store
+	current *locksmith.FernetKeys // Keys in the secondary vault, nil if there are none
+	version int                   // Version of the secret in the secondary vault
+	change  string                // Description of the change, empty if the vault is up to date
+}
+
+func syncSecrets(stores []locksmith.Store) {
+	if len(stores) < 2 {
+		log.Fatal("Sync needs at least two vaults")
+	}
+	primary := stores[0]
+	fkeys, err := locksmith.ReadFernetKeys(primary, cfg.SecretPath)
+	if err != nil {
+		log.Fatalf("Cannot read keys from primary vault %s: %v", primary.Name(), err)
+	}
+
+	var actions []syncAction
+	refused := false
+	// The preview is replaced by the plan in dry run
+	preview := func(format string, a ...interface{}) {
+		if !cfg.DryRun {
+			fmt.Printf(format, a...)
+		}
+	}
+	preview("Primary %s: %d keys created at %s, primary key %s\n", primary.Name(), len(fkeys.Keys), time.Unix(fkeys.CreationTime, 0).UTC().Format(time.RFC3339), fkeys.PrimaryFingerprint())
+	for _, v := range stores[1:] {
+		a := syncAction{vault: v}
+		s, version, err := v.ReadVersion(cfg.SecretPath)
+		if err != nil {
+			log.Fatalf("Cannot read secret from %s: %v", v.Name(), err)
+		}
+		a.version = version
+		if s == nil {
+			a.change = "create keys"
+		} else {
+			current, err := locksmith.DecodeFernetKeys(s)
+			if err != nil {
+				log.Fatalf("Cannot read keys from %s: %v", v.Name(), err)
+			}
+			a.current = current
+			switch {
+			case current.Equal(fkeys):
+			case current.CreationTime > fkeys.CreationTime:
+				a.change = fmt.Sprintf("REFUSED: keys created at %s are newer than the primary keys", time.Unix(current.CreationTime, 0).UTC().Format(time.RFC3339))
+				refused = true
+			default:
+				a.change = fmt.Sprintf("replace keys created at %s, %d of %d keys differ",
+					time.Unix(current.CreationTime, 0).UTC().Format(time.RFC3339), len(fkeys.Keys)-fkeys.SharedKeys(current), len(fkeys.Keys))
+			}
+		}
+		if a.change == "" {
+			preview("Secondary %s: up to date\n", v.Name())
+		} else {
+			preview("Secondary %s: %s\n", v.Name(), a.change)
+		}
+		actions = append(actions, a)
+	}
+
+	if refused {
+		log.Fatal("Refusing to overwrite newer keys, doing nothing")
+	}
+
+	if cfg.DryRun {
+		plan := &locksmith.Plan{Operation: "sync", Path: cfg.SecretPath}
+		plan.Add(primary.Name(), fkeys, fkeys)
+		for _, a := range actions {
+			plan.Add(a.vault.Name(), a.current, fkeys)
+		}
+		exitWithPlan(plan)
+	}
+
+	changes := 0
+	for _, a := range actions {
+		if a.change != "" {
+			changes++
+		}
+	}
+	if changes == 0 {
+		fmt.Println("Nothing to sync")
+		os.Exit(0)
+	}
+
+	var input string
+	if !syncYes {
+		fmt.Printf("Sync %d vault(s) (y/N):", changes)
+		fmt.Scanln(&input)
+	}
+	if !(input == "y" || input == "Y" || input == "yes" || syncYes) {
+		fmt.Println("Doing nothing")
+		os.Exit(0)
+	}
+
+	for _, a := range actions {
+		if a.change == "" {
+			continue
+		}
+		log.Infof("Writing keys to %s", a.vault.Name())
+		if _, err := locksmith.WriteFernetKeys(a.vault, cfg.SecretPath, fkeys, cfg.TTL, a.version); err != nil {
+			log.Fatalf("Error syncing keys: Error writing keys to %s: %v", a.vault.Name(), err)
+		}
+	}
+	fmt.Println("Sync done")
+}
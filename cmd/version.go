@@ -25,8 +25,9 @@ var version string
 
 // versionCmd represents the version command
 var versionCmd = &cobra.Command{
-	Use:   "version",
-	Short: "Print version and exit",
+	Use:         "version",
+	Short:       "Print version and exit",
+	Annotations: supportsDryRun,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Printf("vault-fernet-locksmith version: %s\n", version)
 		fmt.Printf("go version: %s\n", runtime.Version())
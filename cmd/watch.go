@@ -21,16 +21,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/aevox/vault-fernet-locksmith/pkg/consul"
+	"github.com/aevox/vault-fernet-locksmith/pkg/hooks"
 	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
 	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
 
 	health "github.com/docker/go-healthcheck"
-	"github.com/gorilla/mux"
-	consulapi "github.com/hashicorp/consul/api"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -38,15 +39,16 @@ import (
 
 // watchCmd represents the watch command
 var watchCmd = &cobra.Command{
-	Use:   "watch",
-	Short: "Watch keys in Vault(s) and rotate them when needed",
-	Long:  ``,
+	Use:         "watch",
+	Short:       "Watch keys in Vault(s) and rotate them when needed",
+	Annotations: supportsDryRun,
+	Long:        ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		vaultClients, err := createVaultClients()
+		stores, err := createStores()
 		if err != nil {
-			log.Fatalf("Error creating vault clients: %v", err)
+			log.Fatalf("Error creating stores: %v", err)
 		}
-		watch(vaultClients)
+		watch(stores)
 	},
 }
 
@@ -54,182 +56,338 @@ func init() {
 	rootCmd.AddCommand(watchCmd)
 
 	watchCmd.Flags().Int("ttl", 120, "Interval between each vault secret fetch")
-	watchCmd.Flags().Bool("health", false, "enable endpoint /health on port 8080")
+	watchCmd.Flags().Bool("health", false, "enable endpoint /health on the admin server")
 	watchCmd.Flags().Int("health-period", 120, "period between each health check in seconds")
+	watchCmd.Flags().Bool("metrics", false, "enable prometheus endpoint /metrics on the admin server")
+	watchCmd.Flags().Bool("admin", false, "enable the admin server exposing /livez, /readyz and the admin API")
+	watchCmd.Flags().String("admin-address", "0.0.0.0:8080", "listen address of the admin server")
+	watchCmd.Flags().String("admin-tls-cert", "", "PEM-encoded certificate of the admin server")
+	watchCmd.Flags().String("admin-tls-key", "", "PEM-encoded key of the admin server")
+	watchCmd.Flags().String("admin-client-ca", "", "PEM-encoded CA required to sign client certificates of the admin server")
+	watchCmd.Flags().String("admin-token", "", "bearer token required by the admin API")
+	watchCmd.Flags().String("admin-token-file", "", "file containing the bearer token required by the admin API")
+	watchCmd.Flags().String("lock", "", "lock backend ensuring that only one instance of locksmith is running (consul, kubernetes, vault)")
+	watchCmd.Flags().String("lock-name", "vault-fernet-locksmith", "name of the Kubernetes lease used by the lock")
+	watchCmd.Flags().String("lock-namespace", "", "namespace of the Kubernetes lease used by the lock")
+	watchCmd.Flags().String("lock-path", "", "path of the KV version 2 secret used by the vault lock. Defaults to the secret path followed by .lock")
+	watchCmd.Flags().String("lock-identity", "", "identity of this instance in the lock. Defaults to the hostname followed by a random suffix")
+	watchCmd.Flags().Int("lock-lease-duration", 15, "seconds other instances wait before taking over a lease or vault lock that is not renewed")
+	watchCmd.Flags().Int("lock-renew-deadline", 10, "seconds the holder tries to renew the lock before considering it lost")
+	watchCmd.Flags().Int("lock-retry-period", 2, "seconds between attempts to acquire or renew the lock")
 	watchCmd.Flags().Bool("consul-lock", false, "acquires a lock with consul to ensure that only one instance of locksmith is running")
 	watchCmd.Flags().String("consul-lock-key", "locks/locksmith/.lock", "Key used by consul lock")
 	watchCmd.Flags().String("consul-address", "http://127.0.0.1:8200", "Consul address")
 	watchCmd.Flags().String("consul-proxy", "", "Proxy URL used to contact Consul")
 	watchCmd.Flags().String("consul-token", "", "Consul token used to authenticate with consul")
 	watchCmd.Flags().String("consul-token-file", "", "file containing the vault token used to authenticate with Consul")
+	watchCmd.Flags().Bool("reconcile", false, "reconcile vaults automatically when their keys are not identical")
 
 	viper.BindPFlag("ttl", watchCmd.Flags().Lookup("ttl"))
 	viper.BindPFlag("health", watchCmd.Flags().Lookup("health"))
 	viper.BindPFlag("healthPeriod", watchCmd.Flags().Lookup("health-period"))
+	viper.BindPFlag("metrics", watchCmd.Flags().Lookup("metrics"))
+	viper.BindPFlag("admin.enabled", watchCmd.Flags().Lookup("admin"))
+	viper.BindPFlag("admin.address", watchCmd.Flags().Lookup("admin-address"))
+	viper.BindPFlag("admin.tlsCert", watchCmd.Flags().Lookup("admin-tls-cert"))
+	viper.BindPFlag("admin.tlsKey", watchCmd.Flags().Lookup("admin-tls-key"))
+	viper.BindPFlag("admin.clientCA", watchCmd.Flags().Lookup("admin-client-ca"))
+	viper.BindPFlag("admin.token", watchCmd.Flags().Lookup("admin-token"))
+	viper.BindPFlag("admin.tokenFile", watchCmd.Flags().Lookup("admin-token-file"))
+	viper.BindPFlag("lock.backend", watchCmd.Flags().Lookup("lock"))
+	viper.BindPFlag("lock.name", watchCmd.Flags().Lookup("lock-name"))
+	viper.BindPFlag("lock.namespace", watchCmd.Flags().Lookup("lock-namespace"))
+	viper.BindPFlag("lock.path", watchCmd.Flags().Lookup("lock-path"))
+	viper.BindPFlag("lock.identity", watchCmd.Flags().Lookup("lock-identity"))
+	viper.BindPFlag("lock.leaseDuration", watchCmd.Flags().Lookup("lock-lease-duration"))
+	viper.BindPFlag("lock.renewDeadline", watchCmd.Flags().Lookup("lock-renew-deadline"))
+	viper.BindPFlag("lock.retryPeriod", watchCmd.Flags().Lookup("lock-retry-period"))
 	viper.BindPFlag("consul.lock", watchCmd.Flags().Lookup("consul-lock"))
 	viper.BindPFlag("consul.lockKey", watchCmd.Flags().Lookup("consul-lock-key"))
 	viper.BindPFlag("consul.address", watchCmd.Flags().Lookup("consul-address"))
 	viper.BindPFlag("consul.proxy", watchCmd.Flags().Lookup("consul-proxy"))
 	viper.BindPFlag("consul.token", watchCmd.Flags().Lookup("consul-token"))
 	viper.BindPFlag("consul.tokenFile", watchCmd.Flags().Lookup("consul-token-file"))
+	viper.BindPFlag("reconcile.enabled", watchCmd.Flags().Lookup("reconcile"))
 }
 
-func watch(vaultClients []*vault.Vault) {
-	for _, v := range vaultClients {
-		if v.RenewToken {
-			go func(vc *vault.Vault) {
-				for c := time.Tick(time.Duration(cfg.TTL) * time.Second); ; <-c {
-					log.Debugf("Renewing vault token for %s", vc.Client.Address())
-					if err := vc.SelfRenew(); err != nil {
-						log.Warningf("Something went wrong renewing vault token for %s: %v", vc.Client.Address(), err)
-					}
-				}
-			}(v)
+func watch(stores []locksmith.Store) {
+	checkHooks()
+	checkSink()
+	checkSchedule()
+	if cfg.DryRun {
+		planWatch(stores)
+	}
+
+	for _, v := range vaultClients(stores) {
+		if v.RenewToken || v.Auth != nil {
+			go keepAlive(v)
 		}
 	}
 
 	if cfg.Health {
-		for _, vaultClient := range vaultClients {
-			health.Register(fmt.Sprintf("vaultChecker-%s", vaultClient.Client.Address()), health.PeriodicChecker(vaultChecker(vaultClient, cfg.SecretPath), time.Second*time.Duration(cfg.HealthPeriod)))
+		for _, s := range stores {
+			health.Register(fmt.Sprintf("vaultChecker-%s", s.Name()), health.PeriodicChecker(storeChecker(s, cfg.SecretPath), time.Second*time.Duration(cfg.HealthPeriod)))
 		}
+	}
 
-		go func() {
-			// create http server to expose health status
-			r := mux.NewRouter()
-
-			r.HandleFunc("/health", health.StatusHandler)
+	var adminServer *http.Server
+	if cfg.Admin.Enabled || cfg.Health || cfg.Metrics {
+		var err error
+		adminServer, err = startAdminServer(stores)
+		if err != nil {
+			log.Fatalf("Cannot start admin server: %v", err)
+		}
+	}
 
-			srv := &http.Server{
-				Handler:     r,
-				Addr:        "0.0.0.0:8080",
-				ReadTimeout: 15 * time.Second,
-			}
-			log.Fatal(srv.ListenAndServe())
-		}()
+	locker, err := newLocker(stores)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if cfg.Consul.Lock {
-		log.Debug("Creating consul client")
-		var consulToken string
-		if cfg.Consul.Token != "" {
-			consulToken = cfg.Consul.Token
-		} else if cfg.Consul.TokenFile != "" {
-			data, err := ioutil.ReadFile(cfg.Consul.TokenFile)
-			if err != nil {
-				log.Fatalf("Cannot read vault token file: %v", err)
+	// Handle SIGINT and SIGTERM.
+	var lockMu sync.Mutex
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Infof("Recieved signal: %v", sig)
+		shutdownAdminServer(adminServer)
+		lockMu.Lock()
+		if locker != nil && isLeader() {
+			// Attempt to release the lock
+			if err := locker.Unlock(); err != nil {
+				log.Fatalf("Error releasing lock: %v", err)
 			}
-			consulToken = string(data)
+			setLeader(false)
+			lockHeld.Set(0)
 		}
+		os.Exit(0)
+	}()
 
-		consulClient, err := consul.NewClient(cfg.Consul.Address, cfg.Consul.Proxy, consulToken)
-		if err != nil {
-			log.Fatalf("Failed to create consul client: %v", err)
-		}
+	if locker != nil {
 		if cfg.Health {
-			health.Register("consulChecker", health.PeriodicChecker(consulChecker(consulClient.Client, cfg.Consul.LockKey), time.Second*time.Duration(cfg.HealthPeriod)))
+			health.Register(lockBackend()+"Checker", health.PeriodicChecker(lockChecker(locker), time.Second*time.Duration(cfg.HealthPeriod)))
 		}
 
-		log.Info("Attempting to acquire lock...")
-		lock, err := consulClient.Client.LockKey(cfg.Consul.LockKey)
-		if err != nil {
-			log.Fatalf("Lock setup failed :%v", err)
-		}
+		log.Infof("Attempting to acquire lock %s...", locker.Name())
 		stopCh := make(chan struct{})
-		lockCh, err := lock.Lock(stopCh)
+		lockCh, err := locker.Lock(stopCh)
 		if err != nil {
-			log.Fatalf("Failed acquiring lock: %v", err)
+			log.Fatal(err)
 		}
+		lockMu.Lock()
+		setLeader(true)
+		lockHeld.Set(1)
+		lockMu.Unlock()
 		log.Info("Lock acquired")
 
-		// Handle SIGINT and SIGTERM.
-		sigs := make(chan os.Signal)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 		go func() {
-			for {
-				select {
-				case <-lockCh:
-					log.Fatal("Lost lock, Exting")
-				case sig := <-sigs:
-					log.Infof("Recieved signal: %v", sig)
-					if cfg.Consul.Lock {
-						// Attempt to release lock and destroy it
-						if err := consul.CleanLock(lock); err != nil {
-							log.Fatalf("Error cleaning consul lock: %v", err)
-						}
-					}
-					os.Exit(0)
-				}
-			}
+			<-lockCh
+			setLeader(false)
+			lockHeld.Set(0)
+			log.Fatal("Lost lock, Exting")
 		}()
+	} else {
+		setLeader(true)
 	}
 
 	log.Info("Starting")
 	// run smith() every TTL
 	for c := time.Tick(time.Duration(cfg.TTL) * time.Second); ; <-c {
-		if err := smith(vaultClients, cfg.SecretPath, cfg.TTL); err != nil {
+		if err := smith(stores, cfg.SecretPath, cfg.TTL); err != nil {
 			log.Error(err)
 			continue
 		}
 	}
 }
 
-// smith reads the fernet keys in vault and rotates them when their age is less than a TTL away
-// to be equal to the period of rotation.
+// newConsulClient creates the consul client used for the lock
+func newConsulClient() (*consul.Consul, error) {
+	log.Debug("Creating consul client")
+	var consulToken string
+	if cfg.Consul.Token != "" {
+		consulToken = cfg.Consul.Token
+	} else if cfg.Consul.TokenFile != "" {
+		data, err := ioutil.ReadFile(cfg.Consul.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read vault token file: %v", err)
+		}
+		consulToken = string(data)
+	}
+
+	consulClient, err := consul.NewClient(cfg.Consul.Address, cfg.Consul.Proxy, consulToken)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create consul client: %v", err)
+	}
+	return consulClient, nil
+}
+
+// planWatch prints the plan of the next iteration of the watch loop and exits
+func planWatch(stores []locksmith.Store) {
+	plan := &locksmith.Plan{Operation: "watch", Path: cfg.SecretPath}
+
+	standby := false
+	locker, err := newLocker(stores)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if locker != nil {
+		holder, err := locker.Holder()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if holder != "" {
+			standby = true
+			plan.Note(fmt.Sprintf("Lock %s is held by %s: this instance would wait for it", locker.Name(), holder))
+		} else {
+			plan.Note(fmt.Sprintf("Lock %s is free and would be acquired", locker.Name()))
+		}
+	}
+
+	fkeys, err := locksmith.GetFernetKeys(stores, cfg.SecretPath)
+	if err != nil {
+		log.Fatalf("Cannot plan rotation: %v", err)
+	}
+
+	next := fkeys
+	if !standby {
+		d, err := decideRotation(fkeys, cfg.TTL)
+		if err != nil {
+			log.Fatalf("Cannot plan rotation: %v", err)
+		}
+		switch {
+		case d.Rotate:
+			next = fkeys.Copy()
+			if err := next.Rotate(0); err != nil {
+				log.Fatalf("Error rotating keys: %v", err)
+			}
+			if d.Forced {
+				plan.Note("Keys would be rotated in a blackout window to honor the maximum deferral or age of the keys")
+			} else {
+				plan.Note(fmt.Sprintf("Keys are due for rotation since %s", d.Due.Format(time.RFC3339)))
+			}
+		case !d.Deferred.IsZero():
+			plan.Note(fmt.Sprintf("Rotation due since %s would be deferred to %s by a blackout window", d.Due.Format(time.RFC3339), d.Deferred.Format(time.RFC3339)))
+		default:
+			plan.Note(fmt.Sprintf("Keys are fresh, next rotation at %s", d.Due.Format(time.RFC3339)))
+		}
+	}
+	for _, v := range stores {
+		plan.Add(v.Name(), fkeys, next)
+	}
+	exitWithPlan(plan)
+}
+
+// keepAlive renews the token of a vault client every TTL, or logs in again when needed
+func keepAlive(v *vault.Vault) {
+	// Log in again when the token would expire before the next two ticks
+	margin := 2 * time.Duration(cfg.TTL) * time.Second
+	for c := time.Tick(time.Duration(cfg.TTL) * time.Second); ; <-c {
+		log.Debugf("Renewing vault token for %s", v.Name())
+		if err := v.KeepAlive(margin); err != nil {
+			tokenRenewalFailures.WithLabelValues(v.Name()).Inc()
+			log.Warningf("Something went wrong renewing vault token for %s: %v", v.Name(), err)
+		}
+	}
+}
+
+// smithMu serializes the changes made to the keys by the watch loop and the admin API
+var smithMu sync.Mutex
+
+// smith reads the fernet keys in vault and rotates them when the rotation policy says they are due:
+// by default when their age is less than a TTL away to be equal to the period of rotation.
 // If ls.RenewVaultToken is true, it tries to renew the vault clients token before reading secrets.
-func smith(vlist []*vault.Vault, path string, ttl int) error {
+func smith(vlist []locksmith.Store, path string, ttl int) error {
+	smithMu.Lock()
+	defer smithMu.Unlock()
 
-	log.Debug("Getting fernet keys")
-	fkeys, err := locksmith.GetFernetKeys(vlist, path)
+	fkeys, err := currentFernetKeys(vlist, path, ttl)
 	if err != nil {
 		return fmt.Errorf("Cannot smith new keys: %v", err)
 	}
 
-	if time.Now().Unix() < (fkeys.CreationTime + fkeys.Period - int64(ttl)) {
+	d, err := decideRotation(fkeys, ttl)
+	if err != nil {
+		return fmt.Errorf("Cannot smith new keys: %v", err)
+	}
+	if !d.Rotate {
+		// Repair the secret if a previous write failed or it was modified
+		writeSink(fkeys)
+		if !d.Deferred.IsZero() {
+			log.Infof("Rotation due since %s deferred to %s by a blackout window", d.Due.Format(time.RFC3339), d.Deferred.Format(time.RFC3339))
+			return nil
+		}
 		log.Debug("All keys are fresh, no rotation needed")
 		return nil
 	}
 
+	if d.Forced {
+		log.Warn("Rotating keys in a blackout window to honor the maximum deferral or age of the keys")
+	}
 	log.Info("Time to rotate keys")
 	// rotate(0) means that we do not change the period
-	if err := fkeys.Rotate(0); err != nil {
+	return rotateFernetKeys(vlist, path, fkeys, 0, ttl)
+}
+
+// currentFernetKeys reads the fernet keys in vault, reconciling the vaults first
+// if their keys diverged and reconciliation is enabled
+func currentFernetKeys(vlist []locksmith.Store, path string, ttl int) (*locksmith.FernetKeys, error) {
+	log.Debug("Getting fernet keys")
+	fkeys, err := locksmith.GetFernetKeys(vlist, path)
+	if err == locksmith.ErrKeysDiverged {
+		keysDiverged.Set(1)
+		if cfg.Reconcile.Enabled {
+			log.Warn("Keys are not identical in each vaults, reconciling")
+			fkeys, err = reconcile(vlist, path, ttl)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	keysDiverged.Set(0)
+	observeKeys(fkeys, ttl)
+	return fkeys, nil
+}
+
+// rotateFernetKeys rotates fkeys and writes them to every vault, rolling back on failure.
+// A period of 0 keeps the current period.
+func rotateFernetKeys(vlist []locksmith.Store, path string, fkeys *locksmith.FernetKeys, period int64, ttl int) error {
+	previous := fkeys.Copy()
+	if err := fkeys.Rotate(period); err != nil {
 		return fmt.Errorf("Error rotating keys: %v", err)
 	}
-	log.Debugf("New keys: %v", *fkeys)
+	log.Debugf("New keys: %s", strings.Join(fkeys.Fingerprints(), ", "))
 
-	for _, v := range vlist {
-		vaultName := v.Client.Address()
-		log.Infof("Writing keys to %s", vaultName)
-		if err := locksmith.WriteFernetKeys(v, path, fkeys, ttl); err != nil {
-			return fmt.Errorf("Cannot write fernet keys to %s : %v", vaultName, err)
+	if err := preRotationHooks(vlist, fkeys); err != nil {
+		return err
+	}
+
+	log.Info("Writing keys to stores")
+	if err := locksmith.CommitFernetKeys(vlist, path, previous, fkeys, ttl); err != nil {
+		rotationFailures.Inc()
+		if rerr, ok := err.(*locksmith.RotationError); ok && !rerr.Consistent() {
+			keysDiverged.Set(1)
 		}
-		log.Debugf("Keys written to %s", vaultName)
+		logRotationError(err)
+		return errors.New("Rotation failed")
 	}
-	log.Infof("Rotation complete")
+	observeRotation(time.Now())
+	observeKeys(fkeys, ttl)
+	log.Infof("Rotation complete, primary key is now %s", fkeys.PrimaryFingerprint())
+	writeSink(fkeys)
+	notifyHooks(hooks.EventRotation, vlist, fkeys)
 
 	return nil
 }
 
-func vaultChecker(v *vault.Vault, path string) health.Checker {
+func storeChecker(v locksmith.Store, path string) health.Checker {
 	return health.CheckFunc(func() error {
 		b, err := v.Read(path)
 		if err != nil {
-			return fmt.Errorf("Cannot access vault: %v", err)
+			return fmt.Errorf("Cannot access %s: %v", v.Name(), err)
 		}
 		if b == nil {
-			return fmt.Errorf("%s is empty in %s", path, v.Client.Address())
-		}
-		return nil
-	})
-}
-
-func consulChecker(c *consulapi.Client, key string) health.Checker {
-	return health.CheckFunc(func() error {
-		lock, _, err := c.KV().Get(key, &consulapi.QueryOptions{})
-		if err != nil {
-			return fmt.Errorf("Cannot access consul lock: %v", err)
-		}
-		if lock == nil {
-			return errors.New("Lock does not exist")
+			return fmt.Errorf("%s is empty in %s", path, v.Name())
 		}
 		return nil
 	})
@@ -12,7 +12,8 @@ import (
 
 // Consul represents a means for interacting with a remote consul client.
 type Consul struct {
-	Client *consulapi.Client
+	Client  *consulapi.Client
+	Address string
 }
 
 // NewClient creates a new consul client
@@ -42,7 +43,7 @@ func NewClient(address string, proxy string, token string) (*Consul, error) {
 		return nil, fmt.Errorf("ERROR communicating with consul server: %v", err)
 	}
 
-	return &Consul{Client: client}, nil
+	return &Consul{Client: client, Address: address}, nil
 }
 
 // CleanLock attempts to release a lock and destroy it
@@ -0,0 +1,73 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Lock is a lock held with a consul session on a key
+type Lock struct {
+	Consul *Consul
+	Key    string
+
+	mu   sync.Mutex
+	lock *consulapi.Lock
+}
+
+// NewLock creates a lock on key
+func NewLock(c *Consul, key string) *Lock {
+	return &Lock{Consul: c, Key: key}
+}
+
+// Name returns the key of the lock
+func (l *Lock) Name() string {
+	return l.Key
+}
+
+// Lock blocks until the lock is acquired or stopCh is closed. The returned channel
+// is closed when the session holding the lock is invalidated.
+func (l *Lock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	lock, err := l.Consul.Client.LockKey(l.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Lock setup failed: %v", err)
+	}
+	lostCh, err := lock.Lock(stopCh)
+	if err != nil {
+		return nil, fmt.Errorf("Failed acquiring lock: %v", err)
+	}
+	if lostCh != nil {
+		l.mu.Lock()
+		l.lock = lock
+		l.mu.Unlock()
+	}
+	return lostCh, nil
+}
+
+// Unlock releases the lock and destroys it if no other instance waits for it
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lock == nil {
+		return errors.New("Lock is not held")
+	}
+	if err := CleanLock(l.lock); err != nil {
+		return err
+	}
+	l.lock = nil
+	return nil
+}
+
+// Holder returns the session holding the lock, or an empty string if it is free
+func (l *Lock) Holder() (string, error) {
+	pair, _, err := l.Consul.Client.KV().Get(l.Key, nil)
+	if err != nil {
+		return "", fmt.Errorf("Cannot access consul lock: %v", err)
+	}
+	if pair == nil || pair.Session == "" {
+		return "", nil
+	}
+	return "session " + pair.Session, nil
+}
@@ -0,0 +1,42 @@
+package consul
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockHolder(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeConsul()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	c, err := NewClient(srv.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLock(c, "locks/locksmith/.lock")
+	var _ locksmith.Locker = l
+	assert.Equal("locks/locksmith/.lock", l.Name())
+
+	holder, err := l.Holder()
+	assert.Nil(err)
+	assert.Equal("", holder)
+
+	// A key without session is a released lock
+	f.set("locks/locksmith/.lock", nil)
+	holder, err = l.Holder()
+	assert.Nil(err)
+	assert.Equal("", holder)
+
+	f.mu.Lock()
+	f.kv["locks/locksmith/.lock"].Session = "4c2a4a3b"
+	f.mu.Unlock()
+	holder, err = l.Holder()
+	assert.Nil(err)
+	assert.Equal("session 4c2a4a3b", holder)
+
+	assert.NotNil(l.Unlock(), "Unlocking a lock that is not held is expected to fail")
+}
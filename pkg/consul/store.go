@@ -0,0 +1,182 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/aevox/vault-fernet-locksmith/pkg/seal"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Store keeps secrets as JSON documents in Consul KV, under a prefix.
+// Documents are encrypted with AES-256-GCM using a key-encryption key, and bound
+// to their consul key.
+// Writes use check-and-set with the ModifyIndex of the key read, like KV
+// version 2 writes in Vault.
+type Store struct {
+	Consul *Consul
+	Prefix string
+
+	sealer *seal.Sealer
+}
+
+// NewStore creates a store keeping secrets under prefix, encrypted with kek,
+// a 32 bytes key-encryption key
+func NewStore(c *Consul, prefix string, kek []byte) (*Store, error) {
+	if kek == nil {
+		return nil, errors.New("Error creating consul store, a key-encryption key is required")
+	}
+	sealer, err := seal.New(kek)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating consul store: %v", err)
+	}
+	return &Store{
+		Consul: c,
+		Prefix: strings.Trim(prefix, "/"),
+		sealer: sealer,
+	}, nil
+}
+
+// Name identifies the store by the address of consul and the prefix of its keys
+func (s *Store) Name() string {
+	name := "consul://" + strings.TrimPrefix(strings.TrimPrefix(s.Consul.Address, "http://"), "https://")
+	if s.Prefix != "" {
+		name += "/" + s.Prefix
+	}
+	return name
+}
+
+// key returns the consul key holding the secret at path
+func (s *Store) key(path string) string {
+	path = strings.Trim(path, "/")
+	if s.Prefix == "" {
+		return path
+	}
+	return s.Prefix + "/" + path
+}
+
+// decode decrypts the JSON document held by a consul key
+func (s *Store) decode(pair *consulapi.KVPair) ([]byte, error) {
+	value, err := s.sealer.Open(pair.Value, []byte(pair.Key))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt %s: %v", pair.Key, err)
+	}
+	if !json.Valid(value) {
+		return nil, fmt.Errorf("Value of %s in consul is not JSON", pair.Key)
+	}
+	return value, nil
+}
+
+// Read reads the secret at path, in the {"data": {...}} shape of the Vault API
+func (s *Store) Read(path string) ([]byte, error) {
+	b, _, err := s.ReadVersion(path)
+	return b, err
+}
+
+// ReadVersion reads the secret at path along with the ModifyIndex of its key,
+// 0 if there is no secret
+func (s *Store) ReadVersion(path string) ([]byte, int, error) {
+	pair, _, err := s.Consul.Client.KV().Get(s.key(path), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error reading secret %s from consul: %v", path, err)
+	}
+	if pair == nil {
+		return nil, 0, nil
+	}
+	value, err := s.decode(pair)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := json.Marshal(map[string]json.RawMessage{"data": value})
+	return b, int(pair.ModifyIndex), err
+}
+
+// Write writes a secret if its key is still at the ModifyIndex version, and
+// returns the new ModifyIndex of the key. A version of 0 only creates the key if
+// it does not exist. The write fails with locksmith.ErrCASMismatch if the key has
+// been modified since version was read.
+func (s *Store) Write(path string, data map[string]interface{}, version int) (int, error) {
+	key := s.key(path)
+	value, err := json.Marshal(data)
+	if err != nil {
+		return 0, fmt.Errorf("Error encoding secret %s: %v", path, err)
+	}
+	if value, err = s.sealer.Seal(value, []byte(key)); err != nil {
+		return 0, fmt.Errorf("Cannot encrypt secret %s: %v", path, err)
+	}
+
+	op := &consulapi.KVTxnOp{Verb: consulapi.KVCAS, Key: key, Value: value, Index: uint64(version)}
+	// A transaction returns the ModifyIndex of the key written
+	ok, resp, _, err := s.Consul.Client.KV().Txn(consulapi.KVTxnOps{op}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Error writing secret %s to consul: %v", path, err)
+	}
+	if !ok {
+		if casFailed(resp) {
+			return 0, locksmith.ErrCASMismatch
+		}
+		return 0, fmt.Errorf("Error writing secret %s to consul: %v", path, txnErrors(resp))
+	}
+	if len(resp.Results) > 0 && resp.Results[0] != nil {
+		return int(resp.Results[0].ModifyIndex), nil
+	}
+	return 0, nil
+}
+
+// casFailed returns true if a transaction was rejected because of a stale index
+func casFailed(resp *consulapi.KVTxnResponse) bool {
+	if resp == nil {
+		return false
+	}
+	for _, e := range resp.Errors {
+		if strings.Contains(e.What, "index is stale") {
+			return true
+		}
+	}
+	return false
+}
+
+// txnErrors returns the errors of a rejected transaction
+func txnErrors(resp *consulapi.KVTxnResponse) error {
+	var msgs []string
+	if resp != nil {
+		for _, e := range resp.Errors {
+			msgs = append(msgs, e.What)
+		}
+	}
+	if len(msgs) == 0 {
+		return errors.New("transaction rejected")
+	}
+	return errors.New(strings.Join(msgs, ", "))
+}
+
+// Delete deletes the secret at path
+func (s *Store) Delete(path string) error {
+	if _, err := s.Consul.Client.KV().Delete(s.key(path), nil); err != nil {
+		return fmt.Errorf("Error deleting secret %s in consul: %v", path, err)
+	}
+	return nil
+}
+
+// Watch blocks until the key holding the secret at path is modified after index,
+// or until wait elapses, with a consul blocking query. It returns the index to
+// give to the next call: start with 0, which returns immediately.
+func (s *Store) Watch(path string, index uint64, wait time.Duration) (uint64, error) {
+	_, meta, err := s.Consul.Client.KV().Get(s.key(path), &consulapi.QueryOptions{
+		WaitIndex: index,
+		WaitTime:  wait,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error watching secret %s in consul: %v", path, err)
+	}
+	// The index can go backwards, for example after a snapshot restore
+	if meta.LastIndex < index {
+		return 0, nil
+	}
+	return meta.LastIndex, nil
+}
@@ -0,0 +1,312 @@
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/aevox/vault-fernet-locksmith/pkg/seal"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsul is a consul agent serving the leader status, a KV store with
+// blocking queries, and KV transactions
+type fakeConsul struct {
+	mu      sync.Mutex
+	kv      map[string]*fakePair
+	index   uint64
+	changed chan struct{} // Closed when the KV store is modified
+}
+
+type fakePair struct {
+	Key         string
+	Value       []byte
+	Session     string `json:",omitempty"`
+	ModifyIndex uint64
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{kv: map[string]*fakePair{}, changed: make(chan struct{})}
+}
+
+// modify records a modification of the KV store. The lock must be held.
+func (f *fakeConsul) modify() uint64 {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return f.index
+}
+
+// set sets a key as if another client wrote it
+func (f *fakeConsul) set(key string, value []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kv[key] = &fakePair{Key: key, Value: value, ModifyIndex: f.modify()}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Consul-LastContact", "0")
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	switch {
+	case r.URL.Path == "/v1/status/leader":
+		json.NewEncoder(w).Encode("127.0.0.1:8300")
+	case r.URL.Path == "/v1/txn":
+		f.txn(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.serveKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeConsul) serveKV(w http.ResponseWriter, r *http.Request, key string) {
+	if index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); err == nil && index > 0 {
+		wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil {
+			wait = 5 * time.Minute
+		}
+		f.mu.Lock()
+		current, changed := f.index, f.changed
+		f.mu.Unlock()
+		if current <= index {
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			}
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	switch r.Method {
+	case "GET":
+		pair, ok := f.kv[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*fakePair{pair})
+	case "DELETE":
+		delete(f.kv, key)
+		f.modify()
+		json.NewEncoder(w).Encode(true)
+	}
+}
+
+func (f *fakeConsul) txn(w http.ResponseWriter, r *http.Request) {
+	var ops []struct {
+		KV struct {
+			Verb  string
+			Key   string
+			Value []byte
+			Index uint64
+		}
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &ops); err != nil || len(ops) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	op := ops[0].KV
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if op.Verb == "cas" {
+		var current uint64
+		if pair, ok := f.kv[op.Key]; ok {
+			current = pair.ModifyIndex
+		}
+		if current != op.Index {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Errors": []map[string]interface{}{{"OpIndex": 0, "What": "failed to set key: index is stale"}},
+			})
+			return
+		}
+	}
+	pair := &fakePair{Key: op.Key, Value: op.Value, ModifyIndex: f.modify()}
+	f.kv[op.Key] = pair
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"Results": []map[string]interface{}{{"KV": map[string]interface{}{"Key": pair.Key, "ModifyIndex": pair.ModifyIndex}}},
+	})
+}
+
+var testKEK = bytes.Repeat([]byte{3}, seal.KeySize)
+
+func newTestStore(t *testing.T, prefix string, kek []byte) (*Store, *fakeConsul, func()) {
+	f := newFakeConsul()
+	srv := httptest.NewServer(f)
+	c, err := NewClient(srv.URL, "", "")
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	s, err := NewStore(c, prefix, kek)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return s, f, srv.Close
+}
+
+var testKeys = &locksmith.FernetKeys{
+	Keys: []string{
+		"_lCo9aIptB7q5qb8boRVs99FEbFFFOssbDDo6zUYDXU=",
+		"dpLsGHWSu23w3uc1CVWLdgeWMNothoBLcYxh4u0V_7Y=",
+		"jhPlbcDhWU1GD7UTDp4snD8F9Id2xgowK8hptctENto="},
+	CreationTime: 1,
+	Period:       3600,
+}
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	s, f, cleanup := newTestStore(t, "/locksmith/", testKEK)
+	defer cleanup()
+	var _ locksmith.Store = s
+	var _ locksmith.Watcher = s
+
+	assert.Equal("consul://"+strings.TrimPrefix(s.Consul.Address, "http://")+"/locksmith", s.Name())
+
+	b, err := s.Read("secret/fernet-keys")
+	assert.Nil(err)
+	assert.Nil(b)
+
+	version, err := locksmith.WriteFernetKeys(s, "secret/fernet-keys", testKeys, 120, 0)
+	assert.Nil(err)
+	assert.Contains(f.kv, "locksmith/secret/fernet-keys")
+	assert.Equal(int(f.kv["locksmith/secret/fernet-keys"].ModifyIndex), version)
+
+	got, err := locksmith.ReadFernetKeys(s, "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(testKeys, got)
+
+	assert.Nil(s.Delete("secret/fernet-keys"))
+	assert.Empty(f.kv)
+
+	f.set("locksmith/secret/fernet-keys", []byte("not json"))
+	_, err = s.Read("secret/fernet-keys")
+	assert.NotNil(err)
+}
+
+func TestStoreEncrypted(t *testing.T) {
+	assert := assert.New(t)
+	s, f, cleanup := newTestStore(t, "locksmith", testKEK)
+	defer cleanup()
+
+	_, err := locksmith.WriteFernetKeys(s, "secret/fernet-keys", testKeys, 120, 0)
+	assert.Nil(err)
+	value := f.kv["locksmith/secret/fernet-keys"].Value
+	assert.NotContains(string(value), testKeys.Keys[0], "Keys are expected to be encrypted")
+
+	got, err := locksmith.ReadFernetKeys(s, "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(testKeys, got)
+
+	// Values are bound to their key
+	f.set("locksmith/secret/other", value)
+	_, err = s.Read("secret/other")
+	assert.NotNil(err)
+
+	// Values are not readable without the key-encryption key
+	wrong, err := NewStore(s.Consul, "locksmith", bytes.Repeat([]byte{4}, seal.KeySize))
+	assert.Nil(err)
+	_, err = wrong.Read("secret/fernet-keys")
+	assert.NotNil(err)
+
+	_, err = NewStore(s.Consul, "locksmith", []byte("short"))
+	assert.NotNil(err)
+	_, err = NewStore(s.Consul, "locksmith", nil)
+	assert.NotNil(err, "A store without a key-encryption key is not expected to be created")
+}
+
+func TestStoreCAS(t *testing.T) {
+	assert := assert.New(t)
+	s, f, cleanup := newTestStore(t, "locksmith", testKEK)
+	defer cleanup()
+	other, err := NewStore(s.Consul, "locksmith", testKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key that did not exist when read is only created if it still does not exist
+	_, version, err := s.ReadVersion("secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(0, version)
+	otherVersion, err := other.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, 0)
+	assert.Nil(err)
+	_, err = s.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, version)
+	assert.Equal(locksmith.ErrCASMismatch, err)
+
+	_, version, err = s.ReadVersion("secret/fernet-keys")
+	assert.Nil(err)
+	version, err = s.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, version)
+	assert.Nil(err)
+	// The index returned by a write is used by the next write without reading the key again
+	version, err = s.Write("secret/fernet-keys", map[string]interface{}{"period": 900}, version)
+	assert.Nil(err)
+	assert.Equal(int(f.kv["locksmith/secret/fernet-keys"].ModifyIndex), version)
+
+	_, err = other.Write("secret/fernet-keys", map[string]interface{}{"period": 600}, otherVersion)
+	assert.Equal(locksmith.ErrCASMismatch, err, "A key modified since it was read is not expected to be overwritten")
+}
+
+func TestStoreInterleavedRead(t *testing.T) {
+	s, _, cleanup := newTestStore(t, "locksmith", testKEK)
+	defer cleanup()
+	other, err := NewStore(s.Consul, "locksmith", testKEK)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := s.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, 0)
+	assert.Nil(t, err)
+	// Another locksmith writes the secret, then a health check reads it
+	_, err = other.Write("secret/fernet-keys", map[string]interface{}{"period": 900}, version)
+	assert.Nil(t, err)
+	_, err = s.Read("secret/fernet-keys")
+	assert.Nil(t, err)
+
+	_, err = s.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, version)
+	assert.Equal(t, locksmith.ErrCASMismatch, err, "A read is not expected to change the version of a write")
+}
+
+func TestStoreWatch(t *testing.T) {
+	assert := assert.New(t)
+	s, f, cleanup := newTestStore(t, "locksmith", testKEK)
+	defer cleanup()
+	_, err := s.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, 0)
+	assert.Nil(err)
+
+	index, err := s.Watch("secret/fernet-keys", 0, time.Second)
+	assert.Nil(err)
+	assert.NotZero(index)
+
+	start := time.Now()
+	next, err := s.Watch("secret/fernet-keys", index, 50*time.Millisecond)
+	assert.Nil(err)
+	assert.Equal(index, next, "Watch is expected to time out when nothing changes")
+	assert.True(time.Since(start) >= 50*time.Millisecond)
+
+	done := make(chan uint64)
+	go func() {
+		next, _ := s.Watch("secret/fernet-keys", index, 10*time.Second)
+		done <- next
+	}()
+	time.Sleep(20 * time.Millisecond)
+	f.set("locksmith/secret/fernet-keys", []byte(`{"period": 1800}`))
+	select {
+	case next := <-done:
+		assert.True(next > index)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch is expected to return when the key changes")
+	}
+}
@@ -0,0 +1,216 @@
+// Package filestore keeps fernet keys secrets in local files encrypted with
+// AES-256-GCM, for deployments without Vault.
+package filestore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/aevox/vault-fernet-locksmith/pkg/seal"
+)
+
+// Store keeps each secret in an encrypted file of a directory.
+// Files hold the secret with the same {"data": {...}, "metadata": {"version": n}}
+// shape as a KV version 2 secret. The version is incremented by each write, and
+// writes use check-and-set with the version read, like in Vault. Writes take a
+// lock on the directory, so check-and-set also holds between processes sharing it.
+// The path of the secret is authenticated with the file, so that the files of two
+// secrets cannot be swapped.
+type Store struct {
+	Dir string
+
+	sealer *seal.Sealer
+	mu     sync.Mutex
+}
+
+// secret is the decrypted content of a file
+type secret struct {
+	Data     map[string]interface{} `json:"data"`
+	Metadata metadata               `json:"metadata"`
+}
+
+type metadata struct {
+	Version int `json:"version"`
+}
+
+// New creates a store keeping secrets in dir, encrypted with a 32 bytes key
+func New(dir string, key []byte) (*Store, error) {
+	if dir == "" {
+		return nil, errors.New("Error creating file store, directory is empty")
+	}
+	sealer, err := seal.New(key)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating file store: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Cannot create file store directory: %v", err)
+	}
+	return &Store{Dir: dir, sealer: sealer}, nil
+}
+
+// Name identifies the store by its directory
+func (s *Store) Name() string {
+	return "file://" + s.Dir
+}
+
+// file returns the file holding the secret at path
+func (s *Store) file(path string) (string, error) {
+	clean := filepath.Clean("/" + path)
+	if clean == "/" || strings.HasPrefix(filepath.Base(clean), ".") {
+		return "", fmt.Errorf("Invalid secret path %q", path)
+	}
+	return filepath.Join(s.Dir, clean+".sealed"), nil
+}
+
+// lock takes an exclusive lock on the directory of the store, shared with the other
+// processes using it. The lock is released by closing the returned file.
+func (s *Store) lock() (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(s.Dir, ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot lock file store: %v", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Cannot lock file store: %v", err)
+	}
+	return f, nil
+}
+
+// load reads and decrypts the secret at path. It returns nil if there is no secret.
+func (s *Store) load(path string) (*secret, error) {
+	file, err := s.file(path)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read secret %s: %v", path, err)
+	}
+	b, err := s.sealer.Open(sealed, []byte(path))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decrypt secret %s: %v", path, err)
+	}
+	var sec secret
+	if err := json.Unmarshal(b, &sec); err != nil {
+		return nil, fmt.Errorf("Error decoding secret %s: %v", path, err)
+	}
+	return &sec, nil
+}
+
+// Read reads the secret at path
+func (s *Store) Read(path string) ([]byte, error) {
+	b, _, err := s.ReadVersion(path)
+	return b, err
+}
+
+// ReadVersion reads the secret at path along with its version, 0 if there is no secret
+func (s *Store) ReadVersion(path string) ([]byte, int, error) {
+	sec, err := s.load(path)
+	if err != nil || sec == nil {
+		return nil, 0, err
+	}
+	b, err := json.Marshal(sec)
+	return b, sec.Metadata.Version, err
+}
+
+// Write writes a secret if it is still at version and returns its new version.
+// It fails with locksmith.ErrCASMismatch if the secret has been modified since
+// version was read.
+func (s *Store) Write(path string, data map[string]interface{}, version int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	current, err := s.load(path)
+	if err != nil {
+		return 0, err
+	}
+	currentVersion := 0
+	if current != nil {
+		currentVersion = current.Metadata.Version
+	}
+	if currentVersion != version {
+		return 0, locksmith.ErrCASMismatch
+	}
+
+	b, err := json.Marshal(secret{Data: data, Metadata: metadata{Version: version + 1}})
+	if err != nil {
+		return 0, fmt.Errorf("Error encoding secret %s: %v", path, err)
+	}
+	sealed, err := s.sealer.Seal(b, []byte(path))
+	if err != nil {
+		return 0, fmt.Errorf("Cannot encrypt secret %s: %v", path, err)
+	}
+	file, err := s.file(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(file, sealed); err != nil {
+		return 0, fmt.Errorf("Error writing secret %s: %v", path, err)
+	}
+	return version + 1, nil
+}
+
+// Delete deletes the secret at path
+func (s *Store) Delete(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	file, err := s.file(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error deleting secret %s: %v", path, err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces a file with data, readable by its owner only
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
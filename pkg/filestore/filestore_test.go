@@ -0,0 +1,183 @@
+package filestore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/aevox/vault-fernet-locksmith/pkg/seal"
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = bytes.Repeat([]byte{7}, seal.KeySize)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(dir, testKey)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	var _ locksmith.Store = s
+
+	b, err := s.Read("secret/fernet-keys")
+	assert.Nil(err)
+	assert.Nil(b)
+
+	fk := &locksmith.FernetKeys{
+		Keys: []string{
+			"_lCo9aIptB7q5qb8boRVs99FEbFFFOssbDDo6zUYDXU=",
+			"dpLsGHWSu23w3uc1CVWLdgeWMNothoBLcYxh4u0V_7Y=",
+			"jhPlbcDhWU1GD7UTDp4snD8F9Id2xgowK8hptctENto="},
+		CreationTime: 1,
+		Period:       3600,
+	}
+	version, err := locksmith.WriteFernetKeys(s, "secret/fernet-keys", fk, 120, 0)
+	assert.Nil(err)
+	assert.Equal(1, version)
+
+	sealed, err := ioutil.ReadFile(filepath.Join(s.Dir, "secret", "fernet-keys.sealed"))
+	assert.Nil(err)
+	assert.NotContains(string(sealed), fk.Keys[0], "Keys are expected to be encrypted")
+
+	got, err := locksmith.ReadFernetKeys(s, "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(fk, got)
+
+	// Another store using the same directory reads the keys
+	other, err := New(s.Dir, testKey)
+	assert.Nil(err)
+	got, err = locksmith.ReadFernetKeys(other, "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(fk, got)
+
+	assert.Nil(s.Delete("secret/fernet-keys"))
+	b, err = s.Read("secret/fernet-keys")
+	assert.Nil(err)
+	assert.Nil(b)
+}
+
+func TestStoreCAS(t *testing.T) {
+	assert := assert.New(t)
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	other, err := New(s.Dir, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, 0)
+	assert.Nil(err)
+	_, err = s.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, 0)
+	assert.Equal(locksmith.ErrCASMismatch, err, "An existing secret is not expected to be created again")
+
+	_, otherVersion, err := other.ReadVersion("secret/fernet-keys")
+	assert.Nil(err)
+	_, version, err := s.ReadVersion("secret/fernet-keys")
+	assert.Nil(err)
+
+	version, err = s.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, version)
+	assert.Nil(err)
+	assert.Equal(2, version)
+	_, err = other.Write("secret/fernet-keys", map[string]interface{}{"period": 900}, otherVersion)
+	assert.Equal(locksmith.ErrCASMismatch, err, "A secret modified since it was read is not expected to be overwritten")
+
+	_, otherVersion, err = other.ReadVersion("secret/fernet-keys")
+	assert.Nil(err)
+	_, err = other.Write("secret/fernet-keys", map[string]interface{}{"period": 900}, otherVersion)
+	assert.Nil(err)
+}
+
+func TestStoreInterleavedRead(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	other, err := New(s.Dir, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := s.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, 0)
+	assert.Nil(t, err)
+	// Another process writes the secret, then a health check reads it
+	_, err = other.Write("secret/fernet-keys", map[string]interface{}{"period": 900}, version)
+	assert.Nil(t, err)
+	_, err = s.Read("secret/fernet-keys")
+	assert.Nil(t, err)
+
+	_, err = s.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, version)
+	assert.Equal(t, locksmith.ErrCASMismatch, err, "A read is not expected to change the version of a write")
+}
+
+func TestStoreConcurrentWrites(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	version, err := s.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, 0)
+	assert.Nil(t, err)
+
+	// Stores sharing the directory, as separate processes would
+	var stores []*Store
+	for i := 0; i < 20; i++ {
+		other, err := New(s.Dir, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, other)
+	}
+	var wg sync.WaitGroup
+	var written int32
+	for _, other := range stores {
+		wg.Add(1)
+		go func(other *Store) {
+			defer wg.Done()
+			if _, err := other.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, version); err == nil {
+				atomic.AddInt32(&written, 1)
+			}
+		}(other)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), written, "Only one of the writes of the same version is expected to succeed")
+}
+
+func TestStoreTampering(t *testing.T) {
+	assert := assert.New(t)
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	_, err := s.Write("secret/a", map[string]interface{}{"period": 3600}, 0)
+	assert.Nil(err)
+	_, err = s.Write("secret/b", map[string]interface{}{"period": 1800}, 0)
+	assert.Nil(err)
+
+	// Files are bound to their path
+	a, _ := ioutil.ReadFile(filepath.Join(s.Dir, "secret", "a.sealed"))
+	assert.Nil(ioutil.WriteFile(filepath.Join(s.Dir, "secret", "b.sealed"), a, 0600))
+	_, err = s.Read("secret/b")
+	assert.NotNil(err)
+
+	wrongKey, err := New(s.Dir, bytes.Repeat([]byte{8}, seal.KeySize))
+	assert.Nil(err)
+	_, err = wrongKey.Read("secret/a")
+	assert.NotNil(err)
+
+	_, err = s.Write("../outside", map[string]interface{}{"period": 900}, 0)
+	assert.Nil(err)
+	_, err = os.Stat(filepath.Join(s.Dir, "outside.sealed"))
+	assert.Nil(err, "Paths are expected to stay in the store directory")
+	_, err = s.Read("/")
+	assert.NotNil(err)
+}
@@ -0,0 +1,9 @@
+package filestore
+
+import "os"
+
+// lockFile does nothing as file locks are not supported on windows: check-and-set
+// only holds within one process
+func lockFile(f *os.File) error {
+	return nil
+}
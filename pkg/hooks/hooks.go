@@ -0,0 +1,266 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a change of the fernet keys triggering hooks
+type Event string
+
+const (
+	// EventPreRotation happens before new keys are written. Hooks may veto the rotation.
+	EventPreRotation Event = "pre-rotation"
+	// EventRotation happens after the keys have been rotated
+	EventRotation Event = "rotation"
+	// EventBootstrap happens after the keys have been bootstrapped
+	EventBootstrap Event = "bootstrap"
+	// EventDelete happens after the keys have been deleted
+	EventDelete Event = "delete"
+)
+
+// SignatureHeader is the header holding the HMAC-SHA256 signature of a webhook payload
+const SignatureHeader = "X-Locksmith-Signature"
+
+// DefaultTimeout is the timeout of a hook when none is set
+const DefaultTimeout = 30 * time.Second
+
+// Payload describes a change of the fernet keys. The keys themselves are only
+// included for hooks explicitly allowed to receive them.
+type Payload struct {
+	Event        Event    `json:"event"`
+	Path         string   `json:"path"`
+	Vaults       []string `json:"vaults"`
+	Timestamp    int64    `json:"timestamp"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	Primary      string   `json:"primary,omitempty"`
+	CreationTime int64    `json:"creation_time,omitempty"`
+	Period       int64    `json:"period,omitempty"`
+	Keys         []string `json:"keys,omitempty"`
+}
+
+// Hook is a command or a webhook run when the keys change
+type Hook struct {
+	Name          string
+	Events        []Event       // Events triggering the hook
+	Command       []string      // Command executed with the payload on stdin
+	URL           string        // URL the payload is posted to
+	Secret        string        // Secret used to sign the webhook payload
+	Timeout       time.Duration // Timeout of each attempt
+	Retries       int           // Number of retries after a failed attempt
+	RetryInterval time.Duration // Time waited between attempts
+	IncludeKeys   bool          // Send the raw keys to the hook
+	Veto          bool          // A failure of this pre-rotation hook aborts the rotation
+}
+
+// Failure is the error returned by a hook
+type Failure struct {
+	Hook string
+	Veto bool
+	Err  error
+}
+
+// Error is returned by Run when hooks failed
+type Error struct {
+	Failures []Failure
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = fmt.Sprintf("hook %s: %v", f.Hook, f.Err)
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Vetoed returns true if a failed hook was allowed to veto the change
+func (e *Error) Vetoed() bool {
+	for _, f := range e.Failures {
+		if f.Veto {
+			return true
+		}
+	}
+	return false
+}
+
+// Triggered returns true if the hook runs on the event
+func (h *Hook) Triggered(event Event) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns an error if the hook is misconfigured
+func (h *Hook) Check() error {
+	if (len(h.Command) == 0) == (h.URL == "") {
+		return fmt.Errorf("Hook %s must have either a command or a url", h.Name)
+	}
+	if h.URL != "" && h.Secret == "" {
+		return fmt.Errorf("Hook %s must have a secret to sign its webhook payload", h.Name)
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("Hook %s has no event", h.Name)
+	}
+	for _, e := range h.Events {
+		switch e {
+		case EventPreRotation, EventRotation, EventBootstrap, EventDelete:
+		default:
+			return fmt.Errorf("Hook %s has an unknown event %q", h.Name, e)
+		}
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("Hook %s must have a positive number of retries", h.Name)
+	}
+	return nil
+}
+
+// Run runs the hooks triggered by the event of the payload, in order.
+// Every hook is run even if one fails; failures are returned as an *Error.
+func Run(hooks []*Hook, p *Payload) error {
+	var failures []Failure
+	for _, h := range hooks {
+		if !h.Triggered(p.Event) {
+			continue
+		}
+		if err := h.Run(p); err != nil {
+			failures = append(failures, Failure{
+				Hook: h.Name,
+				Veto: h.Veto && p.Event == EventPreRotation,
+				Err:  err,
+			})
+		}
+	}
+	if failures != nil {
+		return &Error{Failures: failures}
+	}
+	return nil
+}
+
+// Run runs the hook with the payload, retrying failed attempts
+func (h *Hook) Run(p *Payload) error {
+	body, err := h.payload(p)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = h.attempt(p, body)
+		if err == nil || attempt >= h.Retries {
+			return err
+		}
+		time.Sleep(h.RetryInterval)
+	}
+}
+
+// payload returns the JSON payload sent to the hook
+func (h *Hook) payload(p *Payload) ([]byte, error) {
+	sent := *p
+	if !h.IncludeKeys {
+		sent.Keys = nil
+	}
+	return json.Marshal(sent)
+}
+
+func (h *Hook) attempt(p *Payload, body []byte) error {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if h.URL != "" {
+		return h.post(ctx, p, body)
+	}
+	return h.exec(ctx, p, body)
+}
+
+// exec runs the command of the hook with the payload on stdin and its metadata in the environment.
+// On timeout, the processes started by the command are killed with it, as they would keep
+// its output open.
+func (h *Hook) exec(ctx context.Context, p *Payload, body []byte) error {
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"LOCKSMITH_EVENT="+string(p.Event),
+		"LOCKSMITH_PATH="+p.Path,
+		"LOCKSMITH_VAULTS="+strings.Join(p.Vaults, ","),
+		"LOCKSMITH_FINGERPRINTS="+strings.Join(p.Fingerprints, ","),
+		"LOCKSMITH_PRIMARY="+p.Primary,
+		"LOCKSMITH_CREATION_TIME="+strconv.FormatInt(p.CreationTime, 10),
+		"LOCKSMITH_PERIOD="+strconv.FormatInt(p.Period, 10),
+	)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(out.String()))
+		}
+		return nil
+	case <-ctx.Done():
+		killProcessGroup(cmd)
+		// Processes that left the group may still keep the output open
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		return errors.New("Timed out")
+	}
+}
+
+// post sends the payload to the URL of the hook, signed with its secret
+func (h *Hook) post(ctx context.Context, p *Payload, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Locksmith-Event", string(p.Event))
+	if h.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(h.Secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", h.URL, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of a webhook payload: "sha256=" followed by the
+// hexadecimal HMAC-SHA256 of the body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,150 @@
+package hooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var payload = &Payload{
+	Event:        EventRotation,
+	Path:         "secret/fernet-keys",
+	Vaults:       []string{"https://vault1", "https://vault2"},
+	Timestamp:    1550000000,
+	Fingerprints: []string{"aaaa", "bbbb", "cccc"},
+	Primary:      "cccc",
+	CreationTime: 1550000000,
+	Period:       3600,
+	Keys:         []string{"key0", "key1", "key2"},
+}
+
+func skipWithoutShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exec hooks are tested with sh")
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	skipWithoutShell(t)
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	h := &Hook{
+		Name:    "exec",
+		Events:  []Event{EventRotation},
+		Command: []string{"sh", "-c", `cat > "$0" && printf "\n%s %s\n" "$LOCKSMITH_EVENT" "$LOCKSMITH_PRIMARY" >> "$0"`, out},
+	}
+	assert.Nil(t, Run([]*Hook{h}, payload))
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(data), "\n", 2)
+	var received Payload
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &received))
+	assert.Equal(t, payload.Fingerprints, received.Fingerprints)
+	assert.Nil(t, received.Keys, "Keys must not be sent by default")
+	assert.NotContains(t, string(data), "key0")
+	assert.Equal(t, "rotation cccc\n", lines[1])
+}
+
+func TestExecHookTimeout(t *testing.T) {
+	skipWithoutShell(t)
+	h := &Hook{
+		Name:    "slow",
+		Events:  []Event{EventRotation},
+		Command: []string{"sleep", "5"},
+		Timeout: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	assert.NotNil(t, h.Run(payload))
+	assert.True(t, time.Since(start) < 4*time.Second)
+
+	// Processes started by the command keep its output open until they are killed
+	h.Command = []string{"sh", "-c", "sleep 5 & sleep 5"}
+	start = time.Now()
+	assert.NotNil(t, h.Run(payload))
+	assert.True(t, time.Since(start) < 4*time.Second, "Processes started by a hook are expected to be killed on timeout")
+}
+
+func TestWebhook(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, Sign("s3cret", body), r.Header.Get(SignatureHeader))
+		var received Payload
+		assert.Nil(t, json.Unmarshal(body, &received))
+		assert.Equal(t, payload.Keys, received.Keys)
+		// Fail the first attempt to exercise retries
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	h := &Hook{
+		Name:        "webhook",
+		Events:      []Event{EventRotation},
+		URL:         srv.URL,
+		Secret:      "s3cret",
+		Retries:     1,
+		IncludeKeys: true,
+	}
+	assert.Nil(t, h.Run(payload))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestRunVeto(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	hooks := []*Hook{
+		{Name: "advisory", Events: []Event{EventPreRotation}, URL: srv.URL},
+		{Name: "veto", Events: []Event{EventPreRotation}, URL: srv.URL, Veto: true},
+		{Name: "after", Events: []Event{EventRotation}, URL: "http://127.0.0.1:0"},
+	}
+
+	pre := *payload
+	pre.Event = EventPreRotation
+	err := Run(hooks, &pre)
+	if assert.IsType(t, &Error{}, err) {
+		herr := err.(*Error)
+		assert.Len(t, herr.Failures, 2)
+		assert.True(t, herr.Vetoed())
+	}
+
+	err = Run(hooks[:1], &pre)
+	if assert.IsType(t, &Error{}, err) {
+		assert.False(t, err.(*Error).Vetoed(), "Only hooks allowed to veto can veto")
+	}
+
+	del := *payload
+	del.Event = EventDelete
+	assert.Nil(t, Run(hooks, &del), "No hook expected to run on delete")
+}
+
+func TestCheck(t *testing.T) {
+	assert.NotNil(t, (&Hook{Name: "none", Events: []Event{EventRotation}}).Check())
+	assert.NotNil(t, (&Hook{Name: "both", Events: []Event{EventRotation}, URL: "http://x", Command: []string{"true"}}).Check())
+	assert.NotNil(t, (&Hook{Name: "unknown", Events: []Event{"later"}, URL: "http://x"}).Check())
+	assert.NotNil(t, (&Hook{Name: "unsigned", Events: []Event{EventRotation}, URL: "http://x"}).Check())
+	assert.Nil(t, (&Hook{Name: "ok", Events: []Event{EventBootstrap}, URL: "http://x", Secret: "s3cret"}).Check())
+	assert.Nil(t, (&Hook{Name: "command", Events: []Event{EventBootstrap}, Command: []string{"true"}}).Check())
+}
@@ -0,0 +1,11 @@
+package hooks
+
+import "os/exec"
+
+// setProcessGroup does nothing as process groups are not supported on windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the command
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package keystone
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedBy returns true if the file belongs to owner
+func ownedBy(fi os.FileInfo, owner Owner) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	return (owner.UID == -1 || int(st.Uid) == owner.UID) && (owner.GID == -1 || int(st.Gid) == owner.GID)
+}
@@ -0,0 +1,238 @@
+package keystone
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fernet/fernet-go"
+)
+
+// Owner holds the owner and group of the key files. -1 keeps the current value.
+type Owner struct {
+	UID int
+	GID int
+}
+
+// NoOwner does not change the owner of the key files
+var NoOwner = Owner{UID: -1, GID: -1}
+
+// WriteRepository writes fernet keys in dir with the layout of a keystone fernet key
+// repository: keys[0] is written to the file 0 (staging key) and keys[len(keys)-1]
+// to the file with the highest index (primary key).
+// Keystone may read the repository at any time, so the keys change without any key
+// of the previous or the new repository missing, and with the previous or the new
+// primary key as the highest index: the keys are first written after the existing
+// files, then to their index, and the extra files are removed. Each file is replaced
+// atomically, and numbered files that do not match a key are removed.
+// It returns true if the repository changed.
+func WriteRepository(dir string, keys []string, owner Owner, mode os.FileMode) (bool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, fmt.Errorf("Cannot create key repository: %v", err)
+	}
+
+	indices, err := keyIndices(dir)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	same, err := sameKeys(dir, keys)
+	if err != nil {
+		return false, err
+	}
+	if !same {
+		next := len(keys)
+		for _, i := range indices {
+			if i >= next {
+				next = i + 1
+			}
+		}
+		// The primary key is written first so that it is the highest index
+		for i := len(keys) - 1; i >= 0; i-- {
+			if err := writeFileAtomic(filepath.Join(dir, strconv.Itoa(next+i)), []byte(keys[i]), owner, mode); err != nil {
+				return true, fmt.Errorf("Cannot write key %d: %v", i, err)
+			}
+		}
+		if err := syncDir(dir); err != nil {
+			return true, err
+		}
+		changed = true
+	}
+
+	for i := len(keys) - 1; i >= 0; i-- {
+		path := filepath.Join(dir, strconv.Itoa(i))
+		ok, err := upToDate(path, []byte(keys[i]), owner, mode)
+		if err != nil {
+			return changed, err
+		}
+		if ok {
+			continue
+		}
+		if err := writeFileAtomic(path, []byte(keys[i]), owner, mode); err != nil {
+			return changed, fmt.Errorf("Cannot write key %d: %v", i, err)
+		}
+		changed = true
+	}
+
+	// Extra files are removed lowest index first, so that the primary key remains
+	// the highest index
+	if indices, err = keyIndices(dir); err != nil {
+		return changed, err
+	}
+	sort.Ints(indices)
+	for _, i := range indices {
+		if i < len(keys) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, strconv.Itoa(i))); err != nil {
+			return changed, fmt.Errorf("Cannot remove stale key %d: %v", i, err)
+		}
+		changed = true
+	}
+
+	if changed {
+		if err := syncDir(dir); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// ReadRepository reads the fernet keys of a keystone fernet key repository.
+// Keys are returned ordered by index: the staging key (file 0) first and the
+// primary key (highest index) last. Each key is validated.
+func ReadRepository(dir string) ([]string, error) {
+	indices, err := keyIndices(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(indices)
+	if len(indices) == 0 || indices[0] != 0 {
+		return nil, fmt.Errorf("No staging key (0) in %s", dir)
+	}
+
+	keys := make([]string, len(indices))
+	for i, index := range indices {
+		b, err := ioutil.ReadFile(filepath.Join(dir, strconv.Itoa(index)))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read key %d: %v", index, err)
+		}
+		key := strings.TrimSpace(string(b))
+		if _, err := fernet.DecodeKey(key); err != nil {
+			return nil, fmt.Errorf("Invalid key %d: %v", index, err)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// keyIndices returns the indices of the numbered files of a key repository
+func keyIndices(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list key repository: %v", err)
+	}
+	var indices []int
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		i, err := strconv.Atoi(f.Name())
+		if err != nil || i < 0 || strconv.Itoa(i) != f.Name() {
+			continue
+		}
+		indices = append(indices, i)
+	}
+	return indices, nil
+}
+
+// sameKeys returns true if the numbered files of dir hold exactly keys
+func sameKeys(dir string, keys []string) (bool, error) {
+	indices, err := keyIndices(dir)
+	if err != nil || len(indices) != len(keys) {
+		return false, err
+	}
+	for i, key := range keys {
+		current, err := ioutil.ReadFile(filepath.Join(dir, strconv.Itoa(i)))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(current, []byte(key)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// upToDate returns true if the file at path has the expected content, owner and mode
+func upToDate(path string, data []byte, owner Owner, mode os.FileMode) (bool, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.Mode().Perm() != mode.Perm() || !ownedBy(fi, owner) {
+		return false, nil
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(current, data), nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it to path
+func writeFileAtomic(path string, data []byte, owner Owner, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if owner.UID != -1 || owner.GID != -1 {
+		if err := f.Chown(owner.UID, owner.GID); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// syncDir flushes the directory entries of dir to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("Cannot sync key repository: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package keystone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readKey(t *testing.T, dir string, name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf("Error reading key %s: %v", name, err)
+	}
+	return string(b)
+}
+
+func TestWriteRepository(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "fernet-keys")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Stale keys from a previous layout
+	ioutil.WriteFile(filepath.Join(dir, "3"), []byte("stale"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "4"), []byte("stale"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0644)
+
+	changed, err := WriteRepository(dir, []string{"staging", "secondary", "primary"}, NoOwner, 0600)
+	assert.Nil(err)
+	assert.True(changed)
+	assert.Equal("staging", readKey(t, dir, "0"))
+	assert.Equal("secondary", readKey(t, dir, "1"))
+	assert.Equal("primary", readKey(t, dir, "2"))
+	for _, name := range []string{"3", "4"} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.True(os.IsNotExist(err), "Stale key %s expected to be removed", name)
+	}
+	_, err = os.Stat(filepath.Join(dir, "README"))
+	assert.Nil(err, "Files that are not keys are expected to be kept")
+
+	fi, err := os.Stat(filepath.Join(dir, "0"))
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	changed, err = WriteRepository(dir, []string{"staging", "secondary", "primary"}, NoOwner, 0600)
+	assert.Nil(err)
+	assert.False(changed, "Repository is not expected to change")
+
+	changed, err = WriteRepository(dir, []string{"staging", "secondary", "primary"}, NoOwner, 0640)
+	assert.Nil(err)
+	assert.True(changed, "Mode change expected to rewrite keys")
+	fi, err = os.Stat(filepath.Join(dir, "2"))
+	assert.Nil(err)
+	assert.Equal(os.FileMode(0640), fi.Mode().Perm())
+}
+
+func TestReadRepository(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "fernet-keys")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// keystone-manage fernet_rotate leaves gaps in indices
+	keys := map[string]string{
+		"0":  "_lCo9aIptB7q5qb8boRVs99FEbFFFOssbDDo6zUYDXU=",
+		"7":  "dpLsGHWSu23w3uc1CVWLdgeWMNothoBLcYxh4u0V_7Y=\n",
+		"12": "jhPlbcDhWU1GD7UTDp4snD8F9Id2xgowK8hptctENto=",
+	}
+	for name, key := range keys {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(key), 0600)
+	}
+
+	read, err := ReadRepository(dir)
+	assert.Nil(err)
+	assert.Equal([]string{
+		"_lCo9aIptB7q5qb8boRVs99FEbFFFOssbDDo6zUYDXU=",
+		"dpLsGHWSu23w3uc1CVWLdgeWMNothoBLcYxh4u0V_7Y=",
+		"jhPlbcDhWU1GD7UTDp4snD8F9Id2xgowK8hptctENto="}, read)
+
+	ioutil.WriteFile(filepath.Join(dir, "13"), []byte("not a fernet key"), 0600)
+	_, err = ReadRepository(dir)
+	assert.NotNil(err, "Invalid keys are expected to be rejected")
+
+	os.Remove(filepath.Join(dir, "13"))
+	os.Remove(filepath.Join(dir, "0"))
+	_, err = ReadRepository(dir)
+	assert.NotNil(err, "Repository without staging key expected to be rejected")
+}
+
+func TestWriteRepositoryRotation(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "fernet-keys")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = WriteRepository(dir, []string{"staging", "secondary", "primary"}, NoOwner, 0600)
+	assert.Nil(err)
+	// An update interrupted after the new keys were written after the existing ones
+	ioutil.WriteFile(filepath.Join(dir, "5"), []byte("staging"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "4"), []byte("primary"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "3"), []byte("new-staging"), 0600)
+
+	changed, err := WriteRepository(dir, []string{"new-staging", "primary", "staging"}, NoOwner, 0600)
+	assert.Nil(err)
+	assert.True(changed)
+	keys, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(keys, 3, "Only the keys are expected in the repository")
+	assert.Equal("new-staging", readKey(t, dir, "0"))
+	assert.Equal("primary", readKey(t, dir, "1"))
+	assert.Equal("staging", readKey(t, dir, "2"))
+}
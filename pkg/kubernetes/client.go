@@ -0,0 +1,191 @@
+// Package kubernetes is a minimal client of the Kubernetes API, able to manage
+// Secrets and Leases with the credentials of a pod or of a kubeconfig.
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Files mounted in pods by the service account admission controller
+const (
+	ServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	tokenFile         = ServiceAccountDir + "/token"
+	caFile            = ServiceAccountDir + "/ca.crt"
+	namespaceFile     = ServiceAccountDir + "/namespace"
+)
+
+var (
+	// ErrNotFound is returned when an object does not exist
+	ErrNotFound = errors.New("Object not found")
+	// ErrConflict is returned when an object has been modified since it was read
+	ErrConflict = errors.New("Object has been modified")
+)
+
+// StatusError is returned when the API server rejects a request
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Kubernetes API returned %d: %s", e.Code, e.Message)
+}
+
+// Client talks to a Kubernetes API server
+type Client struct {
+	Host      string // URL of the API server
+	Namespace string // Namespace of the objects when none is given
+	Token     string // Bearer token
+	TokenFile string // File holding the bearer token, read before each request. Service account tokens are rotated.
+	HTTP      *http.Client
+}
+
+// NewClient creates a client of the API server at host.
+// The server certificate is verified with caPEM when it is not empty, and
+// certificate is presented to the server when it is not nil.
+func NewClient(host string, caPEM []byte, certificate *tls.Certificate) (*Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caPEM) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("Cannot parse the CA certificate of the Kubernetes API server")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if certificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*certificate}
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 2,
+	}
+	return &Client{
+		Host:      strings.TrimSuffix(host, "/"),
+		Namespace: "default",
+		HTTP:      &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// InClusterConfig creates a client with the service account of the pod it runs in
+func InClusterConfig() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read service account CA: %v", err)
+	}
+	if _, err := ioutil.ReadFile(tokenFile); err != nil {
+		return nil, fmt.Errorf("Cannot read service account token: %v", err)
+	}
+	c, err := NewClient("https://"+net.JoinHostPort(host, port), ca, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.TokenFile = tokenFile
+	if ns, err := ioutil.ReadFile(namespaceFile); err == nil && len(bytes.TrimSpace(ns)) != 0 {
+		c.Namespace = string(bytes.TrimSpace(ns))
+	}
+	return c, nil
+}
+
+// token returns the bearer token of the requests
+func (c *Client) token() (string, error) {
+	if c.TokenFile == "" {
+		return c.Token, nil
+	}
+	data, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read token file: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// do sends a request to the API server. in is encoded as the JSON body of the
+// request when it is not nil, and the JSON response is decoded in out when it
+// is not nil. Not found and conflict responses return ErrNotFound and ErrConflict.
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.Host+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := c.token()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return ErrConflict
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		// Errors are described by a Status object
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return &StatusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("Cannot decode response of the Kubernetes API: %v", err)
+	}
+	return nil
+}
+
+// namespace returns ns, or the namespace of the client if it is empty
+func (c *Client) namespace(ns string) string {
+	if ns == "" {
+		return c.Namespace
+	}
+	return ns
+}
@@ -0,0 +1,191 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// kubeconfig holds the parts of a kubeconfig file used by the client.
+// Only bearer tokens and client certificates are supported as credentials.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string      `yaml:"token"`
+			TokenFile             string      `yaml:"tokenFile"`
+			ClientCertificate     string      `yaml:"client-certificate"`
+			ClientCertificateData string      `yaml:"client-certificate-data"`
+			ClientKey             string      `yaml:"client-key"`
+			ClientKeyData         string      `yaml:"client-key-data"`
+			Exec                  interface{} `yaml:"exec"`
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// LoadKubeconfig creates a client with the cluster, user and namespace of a
+// context of the kubeconfig file at path. The current context is used when
+// context is empty. Relative file paths are relative to the kubeconfig file.
+func LoadKubeconfig(path string, context string) (*Client, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read kubeconfig: %v", err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("Cannot parse kubeconfig %s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	resolve := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	if context == "" {
+		context = kc.CurrentContext
+	}
+	if context == "" {
+		return nil, fmt.Errorf("No current context in kubeconfig %s", path)
+	}
+	found := false
+	var clusterName, userName, namespace string
+	for _, c := range kc.Contexts {
+		if c.Name == context {
+			found = true
+			clusterName, userName, namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Context %q not found in kubeconfig %s", context, path)
+	}
+
+	var client *Client
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		if c.Cluster.InsecureSkipTLSVerify {
+			return nil, fmt.Errorf("Cluster %q skips TLS verification, which is not supported", clusterName)
+		}
+		ca, err := fileOrData(resolve(c.Cluster.CertificateAuthority), c.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read CA of cluster %q: %v", clusterName, err)
+		}
+
+		var certificate *tls.Certificate
+		var token, tokenFile string
+		for _, u := range kc.Users {
+			if u.Name != userName {
+				continue
+			}
+			if u.User.Exec != nil || u.User.AuthProvider != nil {
+				return nil, fmt.Errorf("User %q authenticates with a plugin, which is not supported", userName)
+			}
+			token, tokenFile = u.User.Token, resolve(u.User.TokenFile)
+			cert, err := fileOrData(resolve(u.User.ClientCertificate), u.User.ClientCertificateData)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read client certificate of user %q: %v", userName, err)
+			}
+			key, err := fileOrData(resolve(u.User.ClientKey), u.User.ClientKeyData)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read client key of user %q: %v", userName, err)
+			}
+			if cert != nil || key != nil {
+				pair, err := tls.X509KeyPair(cert, key)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid client certificate of user %q: %v", userName, err)
+				}
+				certificate = &pair
+			}
+		}
+
+		if client, err = NewClient(c.Cluster.Server, ca, certificate); err != nil {
+			return nil, err
+		}
+		client.Token, client.TokenFile = token, tokenFile
+	}
+	if client == nil {
+		return nil, fmt.Errorf("Cluster %q not found in kubeconfig %s", clusterName, path)
+	}
+	if namespace != "" {
+		client.Namespace = namespace
+	}
+	return client, nil
+}
+
+// DefaultKubeconfig returns the path of the kubeconfig used by kubectl:
+// the first file of $KUBECONFIG, or ~/.kube/config
+func DefaultKubeconfig() string {
+	if env := filepath.SplitList(os.Getenv("KUBECONFIG")); len(env) != 0 && env[0] != "" {
+		return env[0]
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".kube", "config")
+}
+
+// NewClientFromConfig creates a client with the kubeconfig file at path, or
+// with the service account of the pod when path is empty and it runs in a cluster.
+// Otherwise the default kubeconfig file is used.
+func NewClientFromConfig(path string, context string) (*Client, error) {
+	if path != "" {
+		return LoadKubeconfig(path, context)
+	}
+	if context == "" {
+		c, err := InClusterConfig()
+		if err == nil {
+			return c, nil
+		}
+		if path = DefaultKubeconfig(); path == "" {
+			return nil, err
+		}
+		if _, serr := os.Stat(path); serr != nil {
+			return nil, fmt.Errorf("%v, and no kubeconfig found", err)
+		}
+		return LoadKubeconfig(path, context)
+	}
+	if path = DefaultKubeconfig(); path == "" {
+		return nil, errors.New("No kubeconfig found")
+	}
+	return LoadKubeconfig(path, context)
+}
+
+// fileOrData returns the content of the file at path, or the base64 decoded data
+func fileOrData(path string, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	return nil, nil
+}
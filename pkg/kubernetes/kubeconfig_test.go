@@ -0,0 +1,105 @@
+package kubernetes
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: locksmith
+clusters:
+- name: test
+  cluster:
+    server: %s
+    certificate-authority: ca.crt
+- name: insecure
+  cluster:
+    server: https://127.0.0.1:1
+    insecure-skip-tls-verify: true
+users:
+- name: locksmith
+  user:
+    tokenFile: token
+- name: plugin
+  user:
+    exec:
+      command: aws
+contexts:
+- name: locksmith
+  context:
+    cluster: test
+    user: locksmith
+    namespace: keystone
+- name: insecure
+  context:
+    cluster: insecure
+    user: locksmith
+- name: plugin
+  context:
+    cluster: test
+    user: plugin
+- name: missing
+  context:
+    cluster: missing
+    user: locksmith
+`
+
+func TestLoadKubeconfig(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeAPIServer("kubeconfig-token")
+	srv := httptest.NewTLSServer(f)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	path := filepath.Join(dir, "config")
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0600))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "token"), []byte("kubeconfig-token\n"), 0600))
+	assert.Nil(ioutil.WriteFile(path, []byte(fmt.Sprintf(testKubeconfig, srv.URL)), 0600))
+
+	// Relative paths are relative to the kubeconfig, and the server certificate is verified with its CA
+	c, err := LoadKubeconfig(path, "")
+	if assert.Nil(err) {
+		assert.Equal("keystone", c.Namespace)
+		assert.Equal(filepath.Join(dir, "token"), c.TokenFile)
+		_, err = c.GetSecret("", "fernet-keys")
+		assert.Equal(ErrNotFound, err)
+		assert.Equal("GET "+testSecretPath, f.requests[0])
+	}
+
+	for _, context := range []string{"insecure", "plugin", "missing", "unknown"} {
+		_, err := LoadKubeconfig(path, context)
+		assert.NotNil(err, "Loading context %s is expected to fail", context)
+	}
+
+	// Inline CA data is accepted, and the server is not trusted without it
+	config := fmt.Sprintf(testKubeconfig, srv.URL)
+	inline := strings.Replace(config, "certificate-authority: ca.crt", "certificate-authority-data: "+base64.StdEncoding.EncodeToString(ca), 1)
+	assert.Nil(ioutil.WriteFile(path, []byte(inline), 0600))
+	c, err = LoadKubeconfig(path, "locksmith")
+	if assert.Nil(err) {
+		_, err = c.GetSecret("", "fernet-keys")
+		assert.Equal(ErrNotFound, err)
+	}
+	untrusted := strings.Replace(config, "certificate-authority: ca.crt", "", 1)
+	assert.Nil(ioutil.WriteFile(path, []byte(untrusted), 0600))
+	c, err = LoadKubeconfig(path, "locksmith")
+	if assert.Nil(err) {
+		_, err = c.GetSecret("", "fernet-keys")
+		assert.NotNil(err, "An unknown server certificate is expected to be refused")
+	}
+}
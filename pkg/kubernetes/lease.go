@@ -0,0 +1,289 @@
+package kubernetes
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Lease is a coordination.k8s.io/v1 Lease
+type Lease struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Metadata   ObjectMeta `json:"metadata"`
+	Spec       LeaseSpec  `json:"spec"`
+}
+
+// LeaseSpec is the specification of a Lease. Times are in the MicroTime format.
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// microTime is the format of the times of a Lease
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func leasesPath(namespace string) string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(namespace) + "/leases"
+}
+
+// GetLease reads a lease. It returns ErrNotFound if the lease does not exist.
+func (c *Client) GetLease(namespace, name string) (*Lease, error) {
+	var l Lease
+	if err := c.do("GET", leasesPath(c.namespace(namespace))+"/"+url.PathEscape(name), nil, &l); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// CreateLease creates a lease. It returns ErrConflict if the lease already exists.
+func (c *Client) CreateLease(l *Lease) (*Lease, error) {
+	l.APIVersion, l.Kind = "coordination.k8s.io/v1", "Lease"
+	var created Lease
+	if err := c.do("POST", leasesPath(c.namespace(l.Metadata.Namespace)), l, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateLease replaces a lease. The API server rejects the update with
+// ErrConflict if the lease has been modified since the ResourceVersion of l.
+func (c *Client) UpdateLease(l *Lease) (*Lease, error) {
+	l.APIVersion, l.Kind = "coordination.k8s.io/v1", "Lease"
+	var updated Lease
+	if err := c.do("PUT", leasesPath(c.namespace(l.Metadata.Namespace))+"/"+url.PathEscape(l.Metadata.Name), l, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// Default timings of a LeaseLock, the defaults of the Kubernetes controllers
+const (
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+// LeaseLock is a lock held by renewing a Lease, like the leader election of the
+// Kubernetes controllers.
+// A lease not renewed during its duration is expired and can be taken over. The
+// expiry is measured with the local clock from the time the lease was last seen
+// changing, so the clocks of the candidates do not need to be synchronized.
+type LeaseLock struct {
+	Client        *Client
+	Namespace     string        // Namespace of the lease, the namespace of the client when empty
+	LeaseName     string        // Name of the lease
+	Identity      string        // Identity of this candidate, unique among candidates
+	LeaseDuration time.Duration // Time candidates wait before taking over a lease that is not renewed
+	RenewDeadline time.Duration // Time the holder tries to renew the lease before considering it lost
+	RetryPeriod   time.Duration // Interval between attempts to acquire or renew the lease
+
+	mu           sync.Mutex
+	observed     string    // Resource version of the lease last read
+	observedTime time.Time // Time the lease was last seen changing
+	stopRenew    chan struct{}
+	renewDone    chan struct{}
+}
+
+// NewLeaseLock creates a lock on the lease namespace/name with the default timings
+func NewLeaseLock(c *Client, namespace, name, identity string) *LeaseLock {
+	return &LeaseLock{
+		Client:        c,
+		Namespace:     namespace,
+		LeaseName:     name,
+		Identity:      identity,
+		LeaseDuration: DefaultLeaseDuration,
+		RenewDeadline: DefaultRenewDeadline,
+		RetryPeriod:   DefaultRetryPeriod,
+	}
+}
+
+// Check returns an error if the lock is misconfigured
+func (l *LeaseLock) Check() error {
+	if l.LeaseName == "" {
+		return errors.New("Lease lock has no name")
+	}
+	if l.Identity == "" {
+		return errors.New("Lease lock has no identity")
+	}
+	if l.LeaseDuration < time.Second {
+		return errors.New("Lease duration must be at least one second")
+	}
+	if l.RenewDeadline >= l.LeaseDuration {
+		return errors.New("Renew deadline must be shorter than the lease duration")
+	}
+	if l.RetryPeriod <= 0 || l.RetryPeriod >= l.RenewDeadline {
+		return errors.New("Retry period must be positive and shorter than the renew deadline")
+	}
+	return nil
+}
+
+// Name identifies the lease
+func (l *LeaseLock) Name() string {
+	return fmt.Sprintf("lease %s/%s", l.Client.namespace(l.Namespace), l.LeaseName)
+}
+
+// Lock blocks until the lease is acquired or stopCh is closed. It fails if the
+// client is not allowed to acquire the lease. The lease is then
+// renewed every retry period. The returned channel is closed when the lease could
+// not be renewed before the renew deadline, or when another candidate took it over.
+func (l *LeaseLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	if err := l.Check(); err != nil {
+		return nil, err
+	}
+	for {
+		ok, err := l.tryAcquireOrRenew()
+		if serr, isStatus := err.(*StatusError); isStatus && (serr.Code == 401 || serr.Code == 403) {
+			return nil, fmt.Errorf("Cannot acquire %s: %v", l.Name(), err)
+		}
+		if err != nil {
+			log.Debugf("Cannot acquire %s: %v", l.Name(), err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-stopCh:
+			return nil, nil
+		case <-time.After(l.RetryPeriod):
+		}
+	}
+
+	lostCh := make(chan struct{})
+	stop, done := make(chan struct{}), make(chan struct{})
+	l.mu.Lock()
+	l.stopRenew, l.renewDone = stop, done
+	l.mu.Unlock()
+	go l.renew(stop, done, lostCh)
+	return lostCh, nil
+}
+
+// renew renews the lease every retry period until stop is closed or the lease is lost
+func (l *LeaseLock) renew(stop <-chan struct{}, done chan<- struct{}, lostCh chan<- struct{}) {
+	defer close(done)
+	renewed := time.Now()
+	tick := time.NewTicker(l.RetryPeriod)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+		ok, err := l.tryAcquireOrRenew()
+		switch {
+		case ok:
+			renewed = time.Now()
+			continue
+		case err == nil:
+			log.Warnf("%s has been taken over", l.Name())
+		case time.Since(renewed) < l.RenewDeadline:
+			log.Warnf("Cannot renew %s: %v", l.Name(), err)
+			continue
+		default:
+			log.Warnf("Cannot renew %s before the renew deadline: %v", l.Name(), err)
+		}
+		close(lostCh)
+		return
+	}
+}
+
+// tryAcquireOrRenew acquires or renews the lease. It returns false without error
+// when the lease is held by another candidate, and ErrConflict when another
+// candidate wrote the lease in between.
+func (l *LeaseLock) tryAcquireOrRenew() (bool, error) {
+	now := time.Now()
+	lease, err := l.Client.GetLease(l.Namespace, l.LeaseName)
+	if err == ErrNotFound {
+		lease = &Lease{
+			Metadata: ObjectMeta{Name: l.LeaseName, Namespace: l.Client.namespace(l.Namespace)},
+			Spec: LeaseSpec{
+				HolderIdentity:       l.Identity,
+				LeaseDurationSeconds: int(l.LeaseDuration / time.Second),
+				AcquireTime:          now.Format(microTime),
+				RenewTime:            now.Format(microTime),
+			},
+		}
+		_, err = l.Client.CreateLease(lease)
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	if lease.Metadata.ResourceVersion != l.observed {
+		l.observed, l.observedTime = lease.Metadata.ResourceVersion, now
+	}
+	expiry := l.observedTime.Add(time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second)
+	l.mu.Unlock()
+	if lease.Spec.HolderIdentity != "" && lease.Spec.HolderIdentity != l.Identity && now.Before(expiry) {
+		return false, nil
+	}
+
+	if lease.Spec.HolderIdentity != l.Identity {
+		lease.Spec.HolderIdentity = l.Identity
+		lease.Spec.AcquireTime = now.Format(microTime)
+		lease.Spec.LeaseTransitions++
+	}
+	lease.Spec.LeaseDurationSeconds = int(l.LeaseDuration / time.Second)
+	lease.Spec.RenewTime = now.Format(microTime)
+	_, err = l.Client.UpdateLease(lease)
+	return err == nil, err
+}
+
+// Unlock stops renewing the lease and releases it, so that another candidate can
+// acquire it without waiting for its expiry
+func (l *LeaseLock) Unlock() error {
+	l.mu.Lock()
+	stop, done := l.stopRenew, l.renewDone
+	l.stopRenew, l.renewDone = nil, nil
+	l.mu.Unlock()
+	if stop == nil {
+		return errors.New("Lock is not held")
+	}
+	close(stop)
+	<-done
+
+	lease, err := l.Client.GetLease(l.Namespace, l.LeaseName)
+	if err != nil {
+		return fmt.Errorf("Cannot release %s: %v", l.Name(), err)
+	}
+	if lease.Spec.HolderIdentity != l.Identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	lease.Spec.RenewTime = time.Now().Format(microTime)
+	if _, err := l.Client.UpdateLease(lease); err != nil {
+		return fmt.Errorf("Cannot release %s: %v", l.Name(), err)
+	}
+	return nil
+}
+
+// Holder returns the identity of the holder of the lease, or an empty string if
+// the lease is free or expired according to its renew time
+func (l *LeaseLock) Holder() (string, error) {
+	lease, err := l.Client.GetLease(l.Namespace, l.LeaseName)
+	if err == ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if lease.Spec.HolderIdentity == "" {
+		return "", nil
+	}
+	renewed, err := time.Parse(time.RFC3339Nano, lease.Spec.RenewTime)
+	if err == nil && time.Since(renewed) > time.Duration(lease.Spec.LeaseDurationSeconds)*time.Second {
+		return "", nil
+	}
+	return lease.Spec.HolderIdentity, nil
+}
@@ -0,0 +1,162 @@
+package kubernetes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/locksmith"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLeasePath = "/apis/coordination.k8s.io/v1/namespaces/keystone/leases/locksmith"
+
+func newTestLeaseLock(c *Client, identity string) *LeaseLock {
+	l := NewLeaseLock(c, "", "locksmith", identity)
+	l.LeaseDuration = time.Second
+	l.RenewDeadline = 500 * time.Millisecond
+	l.RetryPeriod = 50 * time.Millisecond
+	return l
+}
+
+// waitLock returns the result of Lock, or fails if the lock is not acquired before timeout
+func waitLock(t *testing.T, l *LeaseLock, stopCh chan struct{}, timeout time.Duration) <-chan struct{} {
+	type result struct {
+		lostCh <-chan struct{}
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		lostCh, err := l.Lock(stopCh)
+		done <- result{lostCh, err}
+	}()
+	select {
+	case r := <-done:
+		assert.Nil(t, r.err)
+		return r.lostCh
+	case <-time.After(timeout):
+		t.Fatalf("%s is expected to acquire the lease within %s", l.Identity, timeout)
+	}
+	return nil
+}
+
+func TestLeaseLock(t *testing.T) {
+	assert := assert.New(t)
+	c, f, cleanup := newTestClient(t)
+	defer cleanup()
+	a, b := newTestLeaseLock(c, "a"), newTestLeaseLock(c, "b")
+	var _ locksmith.Locker = a
+	assert.Equal("lease keystone/locksmith", a.Name())
+
+	holder, err := b.Holder()
+	assert.Nil(err)
+	assert.Equal("", holder)
+
+	lostA := waitLock(t, a, nil, time.Second)
+	holder, err = b.Holder()
+	assert.Nil(err)
+	assert.Equal("a", holder)
+	assert.Equal("a", f.object(testLeasePath)["spec"].(map[string]interface{})["holderIdentity"])
+
+	// b waits while a renews the lease, and acquires it as soon as it is released
+	stopB := make(chan struct{})
+	acquired := make(chan struct{})
+	go func() {
+		if lostCh, err := b.Lock(stopB); err == nil && lostCh != nil {
+			close(acquired)
+		}
+	}()
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case <-acquired:
+		t.Fatal("A renewed lease is not expected to be taken over")
+	case <-lostA:
+		t.Fatal("A renewed lease is not expected to be lost")
+	default:
+	}
+	assert.Nil(a.Unlock())
+	select {
+	case <-acquired:
+	case <-time.After(3 * time.Second):
+		t.Fatal("A released lease is expected to be acquired")
+	}
+	assert.EqualValues(1, f.object(testLeasePath)["spec"].(map[string]interface{})["leaseTransitions"])
+	assert.NotNil(a.Unlock(), "Unlocking a lock that is not held is expected to fail")
+	assert.Nil(b.Unlock())
+
+	// Lock returns when stopped before the lease is acquired
+	lostA = waitLock(t, a, nil, time.Second)
+	stop := make(chan struct{})
+	close(stop)
+	lostB := waitLock(t, b, stop, time.Second)
+	assert.Nil(lostB)
+	assert.Nil(a.Unlock())
+}
+
+func TestLeaseLockExpiry(t *testing.T) {
+	assert := assert.New(t)
+	c, f, cleanup := newTestClient(t)
+	defer cleanup()
+	a, b := newTestLeaseLock(c, "a"), newTestLeaseLock(c, "b")
+
+	// a stops renewing its lease without releasing it, as if it crashed
+	waitLock(t, a, nil, time.Second)
+	a.mu.Lock()
+	close(a.stopRenew)
+	a.mu.Unlock()
+	start := time.Now()
+	lostB := waitLock(t, b, nil, 5*time.Second)
+	assert.True(time.Since(start) >= time.Second, "A lease is expected to be taken over after its duration")
+	holder, err := a.Holder()
+	assert.Nil(err)
+	assert.Equal("b", holder)
+
+	// b loses the lease when another candidate takes it over
+	f.put(testLeasePath, map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "locksmith", "namespace": "keystone"},
+		"spec":     map[string]interface{}{"holderIdentity": "c", "leaseDurationSeconds": 15},
+	})
+	select {
+	case <-lostB:
+	case <-time.After(time.Second):
+		t.Fatal("A lease taken over is expected to be lost")
+	}
+
+	// The holder loses the lease when it cannot renew it before the renew deadline
+	f.put(testLeasePath, map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "locksmith", "namespace": "keystone"},
+		"spec":     map[string]interface{}{},
+	})
+	lostA := waitLock(t, a, nil, time.Second)
+	f.mu.Lock()
+	f.token = "revoked"
+	f.mu.Unlock()
+	select {
+	case <-lostA:
+	case <-time.After(2 * time.Second):
+		t.Fatal("A lease that cannot be renewed is expected to be lost")
+	}
+}
+
+func TestLeaseLockForbidden(t *testing.T) {
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+	c.Token = "wrong"
+	lostCh, err := newTestLeaseLock(c, "a").Lock(nil)
+	assert.NotNil(t, err, "Lock is expected to fail when the client is not allowed to acquire the lease")
+	assert.Nil(t, lostCh)
+}
+
+func TestLeaseLockCheck(t *testing.T) {
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+	assert.Nil(t, NewLeaseLock(c, "", "locksmith", "a").Check())
+
+	for _, l := range []*LeaseLock{
+		NewLeaseLock(c, "", "", "a"),
+		NewLeaseLock(c, "", "locksmith", ""),
+		{Client: c, LeaseName: "locksmith", Identity: "a", LeaseDuration: 10 * time.Second, RenewDeadline: 15 * time.Second, RetryPeriod: time.Second},
+		{Client: c, LeaseName: "locksmith", Identity: "a", LeaseDuration: 15 * time.Second, RenewDeadline: 10 * time.Second},
+	} {
+		assert.NotNil(t, l.Check())
+	}
+}
@@ -0,0 +1,196 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ObjectMeta holds the metadata of an object
+type ObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// Secret is a core/v1 Secret. Data values are base64 encoded in JSON.
+// The fields of a secret read from the API server that are not described here
+// are kept when it is written back.
+type Secret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data"`
+
+	raw map[string]json.RawMessage // Object read from the API server
+}
+
+type secretFields Secret
+
+// UnmarshalJSON decodes a secret and keeps the whole object
+func (s *Secret) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, (*secretFields)(s)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &s.raw)
+}
+
+// MarshalJSON encodes the fields of the secret over the object it was read from
+func (s *Secret) MarshalJSON() ([]byte, error) {
+	metadata := make(map[string]json.RawMessage)
+	if m, ok := s.raw["metadata"]; ok {
+		if err := json.Unmarshal(m, &metadata); err != nil {
+			return nil, err
+		}
+	}
+	setField(metadata, "name", s.Metadata.Name, s.Metadata.Name == "")
+	setField(metadata, "namespace", s.Metadata.Namespace, s.Metadata.Namespace == "")
+	setField(metadata, "resourceVersion", s.Metadata.ResourceVersion, s.Metadata.ResourceVersion == "")
+	setField(metadata, "labels", s.Metadata.Labels, len(s.Metadata.Labels) == 0)
+	setField(metadata, "annotations", s.Metadata.Annotations, len(s.Metadata.Annotations) == 0)
+
+	object := make(map[string]json.RawMessage, len(s.raw))
+	for k, v := range s.raw {
+		object[k] = v
+	}
+	setField(object, "apiVersion", s.APIVersion, false)
+	setField(object, "kind", s.Kind, false)
+	setField(object, "metadata", metadata, false)
+	setField(object, "type", s.Type, s.Type == "")
+	setField(object, "data", s.Data, false)
+	return json.Marshal(object)
+}
+
+// setField sets the field key of a JSON object to v, or removes it if empty is true
+func setField(object map[string]json.RawMessage, key string, v interface{}, empty bool) {
+	if empty {
+		delete(object, key)
+		return
+	}
+	// Strings, maps of strings and maps of bytes are always encoded
+	b, _ := json.Marshal(v)
+	object[key] = b
+}
+
+func secretsPath(namespace string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets"
+}
+
+// GetSecret reads a secret. It returns ErrNotFound if the secret does not exist.
+func (c *Client) GetSecret(namespace, name string) (*Secret, error) {
+	var s Secret
+	if err := c.do("GET", secretsPath(c.namespace(namespace))+"/"+url.PathEscape(name), nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateSecret creates a secret. It returns ErrConflict if the secret already exists.
+func (c *Client) CreateSecret(s *Secret) (*Secret, error) {
+	s.APIVersion, s.Kind = "v1", "Secret"
+	var created Secret
+	if err := c.do("POST", secretsPath(c.namespace(s.Metadata.Namespace)), s, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateSecret replaces a secret. The API server rejects the update with
+// ErrConflict if the secret has been modified since the ResourceVersion of s.
+func (c *Client) UpdateSecret(s *Secret) (*Secret, error) {
+	s.APIVersion, s.Kind = "v1", "Secret"
+	var updated Secret
+	if err := c.do("PUT", secretsPath(c.namespace(s.Metadata.Namespace))+"/"+url.PathEscape(s.Metadata.Name), s, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// ManagedByLabel is the label set on the secrets created by a SecretSink
+const ManagedByLabel = "app.kubernetes.io/managed-by"
+
+// DefaultSinkRetries is the number of retries of a SecretSink when the secret
+// is modified concurrently
+const DefaultSinkRetries = 5
+
+// SecretSink writes fernet keys to a secret with the layout of a keystone fernet
+// key repository: keys[0] is the data key "0" (staging key) and keys[len(keys)-1]
+// the data key with the highest index (primary key). Mounted as a volume, the
+// secret is a key repository.
+type SecretSink struct {
+	Client    *Client
+	Namespace string // Namespace of the secret, the namespace of the client when empty
+	Name      string // Name of the secret
+	ManagedBy string // Value of the managed-by label of a created secret
+	Retries   int    // Retries after a conflict, DefaultSinkRetries when 0
+}
+
+// String identifies the secret written by the sink
+func (s *SecretSink) String() string {
+	return fmt.Sprintf("secret %s/%s", s.Client.namespace(s.Namespace), s.Name)
+}
+
+// Write writes keys to the secret, creating it if it does not exist. Other data
+// keys of the secret are removed, its other fields are kept.
+// Updates are conditioned on the resourceVersion of the secret read, and retried
+// when it has been modified in between. It returns true if the secret changed.
+func (s *SecretSink) Write(keys []string) (bool, error) {
+	data := make(map[string][]byte, len(keys))
+	for i, key := range keys {
+		data[strconv.Itoa(i)] = []byte(key)
+	}
+	retries := s.Retries
+	if retries == 0 {
+		retries = DefaultSinkRetries
+	}
+
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		var current *Secret
+		current, err = s.Client.GetSecret(s.Namespace, s.Name)
+		if err == ErrNotFound {
+			secret := &Secret{
+				Metadata: ObjectMeta{Name: s.Name, Namespace: s.Client.namespace(s.Namespace)},
+				Type:     "Opaque",
+				Data:     data,
+			}
+			if s.ManagedBy != "" {
+				secret.Metadata.Labels = map[string]string{ManagedByLabel: s.ManagedBy}
+			}
+			if _, err = s.Client.CreateSecret(secret); err == ErrConflict {
+				continue
+			}
+			return err == nil, err
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if sameData(current.Data, data) {
+			return false, nil
+		}
+		current.Data = data
+		if _, err = s.Client.UpdateSecret(current); err == ErrConflict {
+			continue
+		}
+		return err == nil, err
+	}
+	return false, fmt.Errorf("Cannot write %s: %v", s, err)
+}
+
+func sameData(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || !bytes.Equal(v, w) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package kubernetes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAPIServer is a Kubernetes API server storing objects as JSON documents,
+// with the optimistic concurrency of resourceVersion
+type fakeAPIServer struct {
+	mu       sync.Mutex
+	token    string
+	objects  map[string]map[string]interface{} // Objects by path
+	version  int
+	conflict int // Number of updates rejected as if the object had been modified
+	requests []string
+}
+
+func newFakeAPIServer(token string) *fakeAPIServer {
+	return &fakeAPIServer{token: token, objects: map[string]map[string]interface{}{}}
+}
+
+// put stores an object as if another client wrote it
+func (f *fakeAPIServer) put(path string, object map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version++
+	object["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.version)
+	f.objects[path] = object
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		f.status(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	var object map[string]interface{}
+	if r.Method == "POST" || r.Method == "PUT" {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &object); err != nil {
+			f.status(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	switch r.Method {
+	case "GET":
+		current, ok := f.objects[r.URL.Path]
+		if !ok {
+			f.status(w, http.StatusNotFound, "not found")
+			return
+		}
+		json.NewEncoder(w).Encode(current)
+	case "POST":
+		path := r.URL.Path + "/" + object["metadata"].(map[string]interface{})["name"].(string)
+		if _, ok := f.objects[path]; ok {
+			f.status(w, http.StatusConflict, "already exists")
+			return
+		}
+		f.store(w, path, object)
+	case "PUT":
+		current, ok := f.objects[r.URL.Path]
+		if !ok {
+			f.status(w, http.StatusNotFound, "not found")
+			return
+		}
+		version := object["metadata"].(map[string]interface{})["resourceVersion"]
+		if f.conflict > 0 {
+			f.conflict--
+			f.version++
+			current["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.version)
+		}
+		if version != current["metadata"].(map[string]interface{})["resourceVersion"] {
+			f.status(w, http.StatusConflict, "the object has been modified")
+			return
+		}
+		f.store(w, r.URL.Path, object)
+	}
+}
+
+// object returns the object stored at path
+func (f *fakeAPIServer) object(path string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[path]
+}
+
+// store stores an object with a new resourceVersion. The lock must be held.
+func (f *fakeAPIServer) store(w http.ResponseWriter, path string, object map[string]interface{}) {
+	f.version++
+	object["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.version)
+	f.objects[path] = object
+	json.NewEncoder(w).Encode(object)
+}
+
+func (f *fakeAPIServer) status(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "code": code, "message": message})
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeAPIServer, func()) {
+	f := newFakeAPIServer("secret-token")
+	srv := httptest.NewServer(f)
+	c, err := NewClient(srv.URL, nil, nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	c.Token = "secret-token"
+	c.Namespace = "keystone"
+	return c, f, srv.Close
+}
+
+var testKeys = []string{
+	"_lCo9aIptB7q5qb8boRVs99FEbFFFOssbDDo6zUYDXU=",
+	"dpLsGHWSu23w3uc1CVWLdgeWMNothoBLcYxh4u0V_7Y=",
+	"jhPlbcDhWU1GD7UTDp4snD8F9Id2xgowK8hptctENto=",
+}
+
+const testSecretPath = "/api/v1/namespaces/keystone/secrets/fernet-keys"
+
+func TestSecretSink(t *testing.T) {
+	assert := assert.New(t)
+	c, f, cleanup := newTestClient(t)
+	defer cleanup()
+	sink := &SecretSink{Client: c, Name: "fernet-keys", ManagedBy: "vault-fernet-locksmith"}
+	assert.Equal("secret keystone/fernet-keys", sink.String())
+
+	changed, err := sink.Write(testKeys)
+	assert.Nil(err)
+	assert.True(changed)
+	s, err := c.GetSecret("", "fernet-keys")
+	assert.Nil(err)
+	assert.Equal("Opaque", s.Type)
+	assert.Equal("vault-fernet-locksmith", s.Metadata.Labels[ManagedByLabel])
+	assert.Equal(map[string][]byte{"0": []byte(testKeys[0]), "1": []byte(testKeys[1]), "2": []byte(testKeys[2])}, s.Data)
+	// Data values are base64 encoded in the API
+	assert.Equal(base64.StdEncoding.EncodeToString([]byte(testKeys[2])), f.objects[testSecretPath]["data"].(map[string]interface{})["2"])
+
+	changed, err = sink.Write(testKeys)
+	assert.Nil(err)
+	assert.False(changed)
+	assert.Equal("GET "+testSecretPath, f.requests[len(f.requests)-1], "An up to date secret is not expected to be written")
+
+	// Stale keys are removed, and the fields the client does not know are kept
+	f.objects[testSecretPath]["metadata"].(map[string]interface{})["ownerReferences"] = []interface{}{map[string]interface{}{"name": "keystone"}}
+	f.objects[testSecretPath]["data"].(map[string]interface{})["3"] = "c3RhbGU="
+	changed, err = sink.Write(testKeys[1:])
+	assert.Nil(err)
+	assert.True(changed)
+	s, err = c.GetSecret("keystone", "fernet-keys")
+	assert.Nil(err)
+	assert.Equal(map[string][]byte{"0": []byte(testKeys[1]), "1": []byte(testKeys[2])}, s.Data)
+	assert.NotNil(f.objects[testSecretPath]["metadata"].(map[string]interface{})["ownerReferences"])
+	assert.Equal("vault-fernet-locksmith", s.Metadata.Labels[ManagedByLabel])
+}
+
+func TestSecretSinkConflict(t *testing.T) {
+	assert := assert.New(t)
+	c, f, cleanup := newTestClient(t)
+	defer cleanup()
+	sink := &SecretSink{Client: c, Name: "fernet-keys", Retries: 2}
+	f.put(testSecretPath, map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "fernet-keys", "namespace": "keystone"},
+		"data":     map[string]interface{}{"0": "c3RhbGU="},
+	})
+
+	// The secret is read again and the update retried when it was modified in between
+	f.conflict = 2
+	changed, err := sink.Write(testKeys)
+	assert.Nil(err)
+	assert.True(changed)
+	s, err := c.GetSecret("", "fernet-keys")
+	assert.Nil(err)
+	assert.Len(s.Data, 3)
+
+	f.conflict = 3
+	_, err = sink.Write(testKeys[1:])
+	assert.NotNil(err, "Write is expected to give up after its retries")
+	assert.True(strings.Contains(err.Error(), "keystone/fernet-keys"))
+}
+
+func TestClientErrors(t *testing.T) {
+	assert := assert.New(t)
+	c, _, cleanup := newTestClient(t)
+	defer cleanup()
+
+	_, err := c.GetSecret("", "missing")
+	assert.Equal(ErrNotFound, err)
+
+	c.Token = "wrong"
+	_, err = c.GetSecret("", "fernet-keys")
+	if assert.IsType(&StatusError{}, err) {
+		assert.Equal(http.StatusUnauthorized, err.(*StatusError).Code)
+		assert.Equal("Unauthorized", err.(*StatusError).Message)
+	}
+}
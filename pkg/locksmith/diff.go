@@ -0,0 +1,145 @@
+package locksmith
+
+import "sort"
+
+// Relations between the keys of a vault and the reference keys
+const (
+	RelationIdentical = "identical" // Same keys and metadata
+	RelationMetadata  = "metadata"  // Same keys, but a different period or creation time
+	RelationBehind    = "behind"    // The reference keys are the keys after one or more rotations
+	RelationAhead     = "ahead"     // The keys are the reference keys after one or more rotations
+	RelationDiverged  = "diverged"  // Some keys are shared, but the keys are not rotations of each other
+	RelationUnrelated = "unrelated" // No key is shared
+)
+
+// KeyPosition lists the vaults holding a key at a position
+type KeyPosition struct {
+	Position    int      `json:"position"`
+	Role        string   `json:"role"`
+	Fingerprint string   `json:"fingerprint"`
+	Vaults      []string `json:"vaults"`
+}
+
+// Relation describes how the keys of a vault relate to the reference keys
+type Relation struct {
+	Vault     string `json:"vault"`
+	Kind      string `json:"relation"`
+	Rotations int    `json:"rotations,omitempty"` // Number of rotations between the keys, when behind or ahead
+	Shared    int    `json:"shared"`              // Number of keys shared with the reference keys
+}
+
+// Diff compares the keys of several vaults
+type Diff struct {
+	Reference string        `json:"reference"`
+	Positions []KeyPosition `json:"positions"`
+	Relations []Relation    `json:"relations"`
+}
+
+// chronology returns the keys from the oldest to the newest: the secondary keys,
+// the primary key and the staging key, which becomes primary at the next rotation
+func (fk FernetKeys) chronology() []string {
+	return append(append([]string{}, fk.Keys[1:]...), fk.Keys[0])
+}
+
+// Rotations returns the number of rotations turning fk into newer. It returns false if
+// newer cannot be obtained by rotating fk, which requires both to hold as many keys.
+// Metadata is ignored.
+func (fk *FernetKeys) Rotations(newer *FernetKeys) (int, bool) {
+	if len(fk.Keys) != len(newer.Keys) || len(fk.Keys) == 0 {
+		return 0, false
+	}
+	older, recent := fk.chronology(), newer.chronology()
+	// Each rotation drops the oldest key and adds a new staging key
+	for n := 0; n < len(older); n++ {
+		if equalKeys(older[n:], recent[:len(older)-n]) {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Relate returns how fk relates to the reference keys, and the number of rotations
+// between them when one is a rotation of the other
+func Relate(fk, reference *FernetKeys) (string, int) {
+	if n, ok := fk.Rotations(reference); ok {
+		if n == 0 {
+			if !fk.Equal(reference) {
+				return RelationMetadata, 0
+			}
+			return RelationIdentical, 0
+		}
+		return RelationBehind, n
+	}
+	if n, ok := reference.Rotations(fk); ok {
+		return RelationAhead, n
+	}
+	if fk.SharedKeys(reference) == 0 {
+		return RelationUnrelated, 0
+	}
+	return RelationDiverged, 0
+}
+
+// NewDiff compares the keysets of the named vaults with the keys of the reference vault
+func NewDiff(names []string, keysets []*FernetKeys, reference int) *Diff {
+	d := &Diff{Reference: names[reference]}
+
+	type position struct {
+		index       int
+		fingerprint string
+	}
+	index := make(map[position]int)
+	for v, fk := range keysets {
+		for i, k := range fk.Keys {
+			key := position{i, Fingerprint(k)}
+			j, ok := index[key]
+			if !ok {
+				j = len(d.Positions)
+				index[key] = j
+				d.Positions = append(d.Positions, KeyPosition{
+					Position:    i,
+					Role:        fk.Role(i),
+					Fingerprint: key.fingerprint,
+				})
+			}
+			d.Positions[j].Vaults = append(d.Positions[j].Vaults, names[v])
+		}
+	}
+	// Group fingerprints by position, keeping their order of appearance
+	sort.SliceStable(d.Positions, func(i, j int) bool {
+		return d.Positions[i].Position < d.Positions[j].Position
+	})
+
+	for v, fk := range keysets {
+		kind, n := Relate(fk, keysets[reference])
+		d.Relations = append(d.Relations, Relation{
+			Vault:     names[v],
+			Kind:      kind,
+			Rotations: n,
+			Shared:    fk.SharedKeys(keysets[reference]),
+		})
+	}
+	return d
+}
+
+// Identical returns true if every vault holds the reference keys with the same metadata,
+// as compared by FernetKeys.Equal
+func (d *Diff) Identical() bool {
+	for _, r := range d.Relations {
+		if r.Kind != RelationIdentical {
+			return false
+		}
+	}
+	return true
+}
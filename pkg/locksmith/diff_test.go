@@ -0,0 +1,95 @@
+package locksmith
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelate(t *testing.T) {
+	assert := assert.New(t)
+	current := fkeys.Copy()
+	once := current.Copy()
+	if err := once.Rotate(0); err != nil {
+		t.Fatal(err)
+	}
+	twice := once.Copy()
+	if err := twice.Rotate(0); err != nil {
+		t.Fatal(err)
+	}
+
+	kind, n := Relate(current, current.Copy())
+	assert.Equal(RelationIdentical, kind)
+	assert.Equal(0, n)
+
+	kind, n = Relate(current, once)
+	assert.Equal(RelationBehind, kind)
+	assert.Equal(1, n)
+	assert.Equal(current.Keys[2], once.Keys[1], "Primary key expected to be the secondary key of the next keys")
+
+	kind, n = Relate(twice, current)
+	assert.Equal(RelationAhead, kind)
+	assert.Equal(2, n)
+
+	// Same keys with different metadata, like a period changed in one vault only
+	period := current.Copy()
+	period.Period = 1800
+	kind, n = Relate(period, current)
+	assert.Equal(RelationMetadata, kind)
+	assert.Equal(0, n)
+	created := current.Copy()
+	created.CreationTime++
+	kind, _ = Relate(created, current)
+	assert.Equal(RelationMetadata, kind)
+
+	diverged := current.Copy()
+	diverged.Keys[0] = "5dbSKEiTFeNfYf5qhQwmvgMbbt3KxFwcScTQc86kL7E="
+	kind, _ = Relate(diverged, current)
+	assert.Equal(RelationDiverged, kind)
+
+	unrelated := &FernetKeys{Keys: []string{"a", "b", "c"}}
+	kind, _ = Relate(unrelated, current)
+	assert.Equal(RelationUnrelated, kind)
+
+	// Rotations cannot change the number of keys
+	shorter := &FernetKeys{Keys: current.Keys[1:]}
+	kind, _ = Relate(shorter, current)
+	assert.Equal(RelationDiverged, kind)
+}
+
+func TestNewDiff(t *testing.T) {
+	assert := assert.New(t)
+	current := fkeys.Copy()
+	next := current.Copy()
+	if err := next.Rotate(0); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDiff([]string{"vault1", "vault2", "vault3"}, []*FernetKeys{current, current.Copy(), next}, 0)
+	assert.Equal("vault1", d.Reference)
+	assert.False(d.Identical())
+
+	fps, nfps := current.Fingerprints(), next.Fingerprints()
+	assert.Equal([]KeyPosition{
+		{Position: 0, Role: RoleStaging, Fingerprint: fps[0], Vaults: []string{"vault1", "vault2"}},
+		{Position: 0, Role: RoleStaging, Fingerprint: nfps[0], Vaults: []string{"vault3"}},
+		{Position: 1, Role: RoleSecondary, Fingerprint: fps[1], Vaults: []string{"vault1", "vault2"}},
+		{Position: 1, Role: RoleSecondary, Fingerprint: nfps[1], Vaults: []string{"vault3"}},
+		{Position: 2, Role: RolePrimary, Fingerprint: fps[2], Vaults: []string{"vault1", "vault2"}},
+		{Position: 2, Role: RolePrimary, Fingerprint: nfps[2], Vaults: []string{"vault3"}},
+	}, d.Positions)
+
+	assert.Equal([]Relation{
+		{Vault: "vault1", Kind: RelationIdentical, Shared: 3},
+		{Vault: "vault2", Kind: RelationIdentical, Shared: 3},
+		{Vault: "vault3", Kind: RelationAhead, Rotations: 1, Shared: 2},
+	}, d.Relations)
+
+	assert.True(NewDiff([]string{"vault1", "vault2"}, []*FernetKeys{current, current}, 1).Identical())
+
+	period := current.Copy()
+	period.Period = 1800
+	d = NewDiff([]string{"vault1", "vault2"}, []*FernetKeys{current, period}, 0)
+	assert.False(d.Identical(), "Keys with different metadata are not expected to be identical")
+	assert.Equal(RelationMetadata, d.Relations[1].Kind)
+}
@@ -0,0 +1,18 @@
+package locksmith
+
+// Locker is a distributed lock electing the instance of the watch command allowed
+// to rotate the keys
+type Locker interface {
+	// Lock blocks until the lock is acquired. It returns a channel closed when the
+	// lock is lost, after which the keys must not be modified anymore.
+	// If stopCh is closed before the lock is acquired, Lock returns a nil channel
+	// and no error.
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+	// Unlock releases the lock so that another instance can acquire it
+	Unlock() error
+	// Holder describes the instance holding the lock, or returns an empty string
+	// if the lock is free
+	Holder() (string, error)
+	// Name identifies the lock in logs and reports
+	Name() string
+}
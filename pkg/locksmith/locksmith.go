@@ -1,16 +1,17 @@
 package locksmith
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fernet/fernet-go"
-
-	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
 )
 
 // FernetKeys represents the fernet keys and their metadata
@@ -34,6 +35,61 @@ func GenerateKey() (string, error) {
 	return key.Encode(), nil
 }
 
+// Fingerprint returns a fingerprint identifying a key without revealing it:
+// the first 16 hexadecimal characters of its SHA-256 hash
+func Fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// Fingerprints returns the fingerprints of the keys, in the same order
+func (fk FernetKeys) Fingerprints() []string {
+	fingerprints := make([]string, len(fk.Keys))
+	for i, k := range fk.Keys {
+		fingerprints[i] = Fingerprint(k)
+	}
+	return fingerprints
+}
+
+// Roles of the keys, as used by keystone
+const (
+	RoleStaging   = "staging"
+	RolePrimary   = "primary"
+	RoleSecondary = "secondary"
+)
+
+// Role returns the role of the i-th key: the first key is the staging key, the last one
+// is the primary key and the keys in between are secondary keys
+func (fk FernetKeys) Role(i int) string {
+	switch i {
+	case 0:
+		return RoleStaging
+	case len(fk.Keys) - 1:
+		return RolePrimary
+	default:
+		return RoleSecondary
+	}
+}
+
+// PrimaryFingerprint returns the fingerprint of the primary key, the last one
+func (fk FernetKeys) PrimaryFingerprint() string {
+	if len(fk.Keys) == 0 {
+		return ""
+	}
+	return Fingerprint(fk.Keys[len(fk.Keys)-1])
+}
+
+// String describes the keys by their fingerprints, so that printing or logging
+// fernet keys never reveals them
+func (fk FernetKeys) String() string {
+	return fmt.Sprintf("{creation_time: %d, period: %d, keys: [%s]}", fk.CreationTime, fk.Period, strings.Join(fk.Fingerprints(), " "))
+}
+
+// GoString is used by the %#v verb, it does not reveal the keys either
+func (fk FernetKeys) GoString() string {
+	return "locksmith.FernetKeys" + fk.String()
+}
+
 // NewFernetKeys creates a new set of fernet keys
 func NewFernetKeys(period int64, numKeys int) (*FernetKeys, error) {
 	keys := make([]string, numKeys, numKeys)
@@ -67,6 +123,19 @@ func (fk FernetKeys) CheckFormat() error {
 	return nil
 }
 
+// Copy returns a deep copy of the fernet keys
+func (fk FernetKeys) Copy() *FernetKeys {
+	keys := make([]string, len(fk.Keys))
+	copy(keys, fk.Keys)
+	fk.Keys = keys
+	return &fk
+}
+
+// Equal returns true if both sets of fernet keys hold the same keys and metadata
+func (fk *FernetKeys) Equal(other *FernetKeys) bool {
+	return reflect.DeepEqual(fk, other)
+}
+
 // Rotate creates a new staging key (Keys[0]), deletes the oldest key in the slice,
 // and update the creation time
 // If period is 0, keep the same period
@@ -86,16 +155,35 @@ func (fk *FernetKeys) Rotate(period int64) error {
 	return nil
 }
 
-// ReadFernetKeys reads a fernet secret from Vault
-func ReadFernetKeys(v vault.Reader, path string) (*FernetKeys, error) {
-	var ks KeysSecret
+// ReadFernetKeys reads a fernet secret from a store
+func ReadFernetKeys(v Reader, path string) (*FernetKeys, error) {
 	b, err := v.Read(path)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading fernet keys secret from vault: %v", err)
+		return nil, fmt.Errorf("Error reading fernet keys secret: %v", err)
 	}
 	if b == nil {
 		return nil, fmt.Errorf("No secret in path %s", path)
 	}
+	return DecodeFernetKeys(b)
+}
+
+// ReadFernetKeysVersion reads a fernet secret from a store along with its version,
+// to give to WriteFernetKeys
+func ReadFernetKeysVersion(v Store, path string) (*FernetKeys, int, error) {
+	b, version, err := v.ReadVersion(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error reading fernet keys secret: %v", err)
+	}
+	if b == nil {
+		return nil, 0, fmt.Errorf("No secret in path %s", path)
+	}
+	fkeys, err := DecodeFernetKeys(b)
+	return fkeys, version, err
+}
+
+// DecodeFernetKeys decodes and checks a fernet secret read from a store
+func DecodeFernetKeys(b []byte) (*FernetKeys, error) {
+	var ks KeysSecret
 	// First decode the JSON into a map[string]interface{}
 	if err := json.Unmarshal(b, &ks); err != nil {
 		return nil, fmt.Errorf("Error decoding json: %v", err)
@@ -109,8 +197,11 @@ func ReadFernetKeys(v vault.Reader, path string) (*FernetKeys, error) {
 	return &fs, nil
 }
 
-// WriteFernetKeys writes the fernet keys as a secret in Vault
-func WriteFernetKeys(v vault.Writer, path string, fs *FernetKeys, ttl int) error {
+// WriteFernetKeys writes the fernet keys as a secret in a store and returns its new
+// version. On stores keeping versions, like a KV version 2 mount, the write uses
+// check-and-set with version, the version of the secret that was read, so that a
+// concurrent rotation is never overwritten.
+func WriteFernetKeys(v Writer, path string, fs *FernetKeys, ttl int, version int) (int, error) {
 	ttlstring := strconv.Itoa(ttl) + "s"
 	m := map[string]interface{}{
 		"keys":          &fs.Keys,
@@ -118,27 +209,27 @@ func WriteFernetKeys(v vault.Writer, path string, fs *FernetKeys, ttl int) error
 		"period":        &fs.Period,
 		"ttl":           ttlstring}
 
-	if err := v.Write(path, m); err != nil {
-		return fmt.Errorf("Error writing keys: %v", err)
+	version, err := v.Write(path, m, version)
+	if err != nil {
+		return 0, fmt.Errorf("Error writing keys: %v", err)
 	}
-	return nil
+	return version, nil
 }
 
-// GetFernetKeys get the fernet keys from a list of vault clients.
-// It returns an error if it does not get identical keys.
-func GetFernetKeys(vlist []*vault.Vault, path string) (*FernetKeys, error) {
+// GetFernetKeys get the fernet keys from a list of stores.
+// It returns ErrKeysDiverged if it does not get identical keys.
+func GetFernetKeys(stores []Store, path string) (*FernetKeys, error) {
 	var fkeysRef *FernetKeys
-	for i, v := range vlist {
-		vaultName := v.Client.Address()
+	for i, v := range stores {
 		fkeys, err := ReadFernetKeys(v, path)
 		if err != nil {
-			return nil, fmt.Errorf("Cannot get keys from vault %s: %v", vaultName, err)
+			return nil, fmt.Errorf("Cannot get keys from %s: %v", v.Name(), err)
 		}
 
 		if i == 0 {
 			fkeysRef = fkeys
-		} else if !reflect.DeepEqual(fkeysRef, fkeys) {
-			return nil, fmt.Errorf("Doing nothing: keys are not identical in each vaults")
+		} else if !fkeysRef.Equal(fkeys) {
+			return nil, ErrKeysDiverged
 		}
 	}
 	return fkeysRef, nil
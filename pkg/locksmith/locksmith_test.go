@@ -1,6 +1,7 @@
 package locksmith
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,8 +37,8 @@ func (v *fakeVault) Read(path string) ([]byte, error) {
 	return []byte{}, nil
 }
 
-func (v *fakeVault) Write(path string, data map[string]interface{}) error {
-	return nil
+func (v *fakeVault) Write(path string, data map[string]interface{}, version int) (int, error) {
+	return 0, nil
 }
 
 func TestNewFernetKeys(t *testing.T) {
@@ -71,3 +72,33 @@ func TestReadFernetKeys(t *testing.T) {
 	}
 	assert.Equal(t, *fkeysRead, fkeys, "The two structs should be equal")
 }
+
+func TestFingerprint(t *testing.T) {
+	assert := assert.New(t)
+	fp := Fingerprint(fkeys.Keys[0])
+	assert.Len(fp, 16)
+	assert.Equal(fp, Fingerprint(fkeys.Keys[0]), "Fingerprints expected to be stable")
+	assert.NotContains(fkeys.Keys[0], fp)
+	fps := fkeys.Fingerprints()
+	assert.Len(fps, len(fkeys.Keys))
+	assert.NotEqual(fps[0], fps[1])
+}
+
+func TestStringHidesKeys(t *testing.T) {
+	fk := fkeys.Copy()
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		for _, v := range []interface{}{fk, *fk} {
+			out := fmt.Sprintf(format, v)
+			for _, k := range fk.Keys {
+				assert.NotContains(t, out, k, "Keys must not be printed with "+format)
+			}
+			assert.Contains(t, out, fk.PrimaryFingerprint())
+		}
+	}
+}
+
+func TestRole(t *testing.T) {
+	assert.Equal(t, RoleStaging, fkeys.Role(0))
+	assert.Equal(t, RoleSecondary, fkeys.Role(1))
+	assert.Equal(t, RolePrimary, fkeys.Role(len(fkeys.Keys)-1))
+}
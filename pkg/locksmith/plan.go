@@ -0,0 +1,74 @@
+package locksmith
+
+// Change describes how the keys held by a vault would change. Keys are
+// identified by their fingerprints, in the order they are stored.
+type Change struct {
+	Vault     string   `json:"vault"`
+	Changed   bool     `json:"changed"`
+	Current   []string `json:"current"`
+	Result    []string `json:"result"`
+	Primary   string   `json:"primary,omitempty"`   // Primary key after the change
+	Discarded []string `json:"discarded,omitempty"` // Keys removed by the change
+}
+
+// Plan describes the changes an operation would make to the keys of each vault
+type Plan struct {
+	Operation string   `json:"operation"`
+	Path      string   `json:"path"`
+	Notes     []string `json:"notes,omitempty"`
+	Changes   []Change `json:"changes"`
+}
+
+// NewChange describes the change from current to next keys in a vault.
+// current is nil when the vault holds no keys, next is nil when the keys are deleted.
+func NewChange(vault string, current, next *FernetKeys) Change {
+	c := Change{
+		Vault:   vault,
+		Current: []string{},
+		Result:  []string{},
+	}
+	if current != nil {
+		c.Current = current.Fingerprints()
+	}
+	if next != nil {
+		c.Result = next.Fingerprints()
+		c.Primary = c.Result[len(c.Result)-1]
+	}
+	switch {
+	case current == nil || next == nil:
+		c.Changed = current != next
+	default:
+		c.Changed = !current.Equal(next)
+	}
+
+	kept := make(map[string]bool, len(c.Result))
+	for _, fp := range c.Result {
+		kept[fp] = true
+	}
+	for _, fp := range c.Current {
+		if !kept[fp] {
+			c.Discarded = append(c.Discarded, fp)
+		}
+	}
+	return c
+}
+
+// Add adds the change from current to next keys in a vault to the plan
+func (p *Plan) Add(vault string, current, next *FernetKeys) {
+	p.Changes = append(p.Changes, NewChange(vault, current, next))
+}
+
+// Note adds a note explaining the plan
+func (p *Plan) Note(note string) {
+	p.Notes = append(p.Notes, note)
+}
+
+// Changed returns true if the plan changes the keys of a vault
+func (p *Plan) Changed() bool {
+	for _, c := range p.Changes {
+		if c.Changed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package locksmith
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan(t *testing.T) {
+	assert := assert.New(t)
+	current := fkeys.Copy()
+	next := fkeys.Copy()
+	if err := next.Rotate(0); err != nil {
+		t.Fatal(err)
+	}
+	fps := current.Fingerprints()
+
+	p := &Plan{Operation: "rotate", Path: "secret/fernet-keys"}
+	p.Add("vault1", current, current)
+	assert.False(p.Changed())
+
+	p.Add("vault2", current, next)
+	assert.True(p.Changed())
+	c := p.Changes[1]
+	assert.Equal(fps, c.Current)
+	assert.Equal(next.Fingerprints(), c.Result)
+	assert.Equal(fps[0], c.Primary, "Staging key expected to become primary")
+	assert.Equal([]string{fps[1]}, c.Discarded, "Oldest secondary key expected to be discarded")
+
+	c = NewChange("vault3", nil, next)
+	assert.True(c.Changed)
+	assert.Empty(c.Current)
+	assert.Nil(c.Discarded)
+
+	c = NewChange("vault4", current, nil)
+	assert.True(c.Changed)
+	assert.Empty(c.Primary)
+	assert.Equal(fps, c.Discarded)
+
+	assert.False(NewChange("vault5", nil, nil).Changed)
+}
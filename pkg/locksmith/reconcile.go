@@ -0,0 +1,179 @@
+package locksmith
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrKeysDiverged is returned when Vaults do not hold identical keys
+var ErrKeysDiverged = errors.New("Doing nothing: keys are not identical in each vaults")
+
+// Strategy selects the authoritative keys when Vaults diverge
+type Strategy string
+
+const (
+	// StrategyPrimary selects the keys of the first Vault
+	StrategyPrimary Strategy = "primary"
+	// StrategyNewest selects the keys with the most recent creation time
+	StrategyNewest Strategy = "newest"
+	// StrategyMajority selects the keys held by a strict majority of Vaults
+	StrategyMajority Strategy = "majority"
+)
+
+// SafetyPolicy defines which divergences are considered safe to repair.
+// Divergences that are not safe may be the result of tampering and are left
+// for an operator to investigate.
+type SafetyPolicy struct {
+	AllowDisjoint bool // Repair keys that share no key with the authoritative keys
+	AllowNewer    bool // Repair keys created after the authoritative keys
+	MaxDivergence int  // Maximum number of authoritative keys missing from the repaired keys, 0 means no limit
+}
+
+// ReconcileOptions holds the options of a reconciliation
+type ReconcileOptions struct {
+	Strategy Strategy
+	Policy   SafetyPolicy
+}
+
+// Authoritative returns the index of the authoritative keys in a list of keys
+// read from each Vault, according to a strategy.
+func Authoritative(keysets []*FernetKeys, strategy Strategy) (int, error) {
+	if len(keysets) == 0 {
+		return 0, errors.New("No keys to choose from")
+	}
+	switch strategy {
+	case StrategyPrimary, "":
+		return 0, nil
+	case StrategyNewest:
+		newest := 0
+		for i, fk := range keysets {
+			if fk.CreationTime > keysets[newest].CreationTime {
+				newest = i
+			}
+		}
+		for _, fk := range keysets {
+			if fk.CreationTime == keysets[newest].CreationTime && !fk.Equal(keysets[newest]) {
+				return 0, errors.New("Several different keys have the most recent creation time")
+			}
+		}
+		return newest, nil
+	case StrategyMajority:
+		for i, fk := range keysets {
+			count := 0
+			for _, other := range keysets {
+				if fk.Equal(other) {
+					count++
+				}
+			}
+			if count*2 > len(keysets) {
+				return i, nil
+			}
+		}
+		return 0, errors.New("No keys are held by a majority of vaults")
+	default:
+		return 0, fmt.Errorf("Unknown reconciliation strategy %q", strategy)
+	}
+}
+
+// SharedKeys returns the number of keys of fk that are also in other
+func (fk *FernetKeys) SharedKeys(other *FernetKeys) int {
+	keys := make(map[string]bool, len(other.Keys))
+	for _, k := range other.Keys {
+		keys[k] = true
+	}
+	shared := 0
+	for _, k := range fk.Keys {
+		if keys[k] {
+			shared++
+		}
+	}
+	return shared
+}
+
+// CheckRepair returns an error if replacing the keys fk by the authoritative keys
+// is not allowed by the safety policy
+func (p SafetyPolicy) CheckRepair(authoritative, fk *FernetKeys) error {
+	shared := authoritative.SharedKeys(fk)
+	if shared == 0 && !p.AllowDisjoint {
+		return errors.New("keys share no key with the authoritative keys")
+	}
+	if fk.CreationTime > authoritative.CreationTime && !p.AllowNewer {
+		return errors.New("keys are newer than the authoritative keys")
+	}
+	if divergence := len(authoritative.Keys) - shared; p.MaxDivergence > 0 && divergence > p.MaxDivergence {
+		return fmt.Errorf("%d authoritative keys are missing, at most %d allowed", divergence, p.MaxDivergence)
+	}
+	return nil
+}
+
+// Reconciliation is the decision of a reconciliation: the authoritative keys and
+// the Vaults holding different keys, to repair with them
+type Reconciliation struct {
+	Authoritative *FernetKeys
+	Source        int           // Index of the Vault holding the authoritative keys
+	Keysets       []*FernetKeys // Keys read in each Vault
+	Lagging       []int         // Indices of the Vaults to repair
+
+	versions []int // Versions of the secrets read, for check-and-set writes
+}
+
+// DecideReconcile reads the fernet keys in every Vault, selects the authoritative keys
+// and the Vaults holding different keys, without writing anything.
+// It returns an error if one of the divergences is not allowed by the safety policy.
+func DecideReconcile(vlist []Store, path string, opts ReconcileOptions) (*Reconciliation, error) {
+	r := &Reconciliation{
+		Keysets:  make([]*FernetKeys, len(vlist)),
+		versions: make([]int, len(vlist)),
+	}
+	for i, v := range vlist {
+		fkeys, version, err := ReadFernetKeysVersion(v, path)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get keys from %s: %v", v.Name(), err)
+		}
+		r.Keysets[i], r.versions[i] = fkeys, version
+	}
+
+	a, err := Authoritative(r.Keysets, opts.Strategy)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot select authoritative keys: %v", err)
+	}
+	r.Source, r.Authoritative = a, r.Keysets[a]
+
+	var refused []string
+	for i, fk := range r.Keysets {
+		if fk.Equal(r.Authoritative) {
+			continue
+		}
+		if err := opts.Policy.CheckRepair(r.Authoritative, fk); err != nil {
+			refused = append(refused, fmt.Sprintf("%s: %v", vlist[i].Name(), err))
+			continue
+		}
+		r.Lagging = append(r.Lagging, i)
+	}
+	if len(refused) > 0 {
+		return nil, fmt.Errorf("Refusing to reconcile keys with %s: %s", vlist[a].Name(), strings.Join(refused, ", "))
+	}
+	return r, nil
+}
+
+// Reconcile reads the fernet keys in every Vault, selects the authoritative keys
+// and writes them to the Vaults holding different keys.
+// It refuses to repair anything if one of the divergences is not allowed by the
+// safety policy. It returns the authoritative keys and the Vaults that were repaired.
+func Reconcile(vlist []Store, path string, opts ReconcileOptions, ttl int) (*FernetKeys, []string, error) {
+	r, err := DecideReconcile(vlist, path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var repaired []string
+	for _, i := range r.Lagging {
+		name := vlist[i].Name()
+		if _, err := WriteFernetKeys(vlist[i], path, r.Authoritative, ttl, r.versions[i]); err != nil {
+			return nil, repaired, fmt.Errorf("Cannot repair keys in %s: %v", name, err)
+		}
+		repaired = append(repaired, name)
+	}
+	return r.Authoritative, repaired, nil
+}
@@ -0,0 +1,122 @@
+package locksmith
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rotated returns a copy of fk rotated n times with creation times increasing by one
+func rotated(t *testing.T, fk *FernetKeys, n int) *FernetKeys {
+	r := fk.Copy()
+	for i := 0; i < n; i++ {
+		if err := r.Rotate(0); err != nil {
+			t.Fatalf("Error rotating keys: %v", err)
+		}
+	}
+	r.CreationTime = fk.CreationTime + int64(n)
+	return r
+}
+
+func TestAuthoritative(t *testing.T) {
+	assert := assert.New(t)
+	older := fkeys.Copy()
+	newer := rotated(t, older, 1)
+
+	i, err := Authoritative([]*FernetKeys{older, newer, newer}, StrategyPrimary)
+	assert.Nil(err)
+	assert.Equal(0, i)
+
+	i, err = Authoritative([]*FernetKeys{older, newer, older}, StrategyNewest)
+	assert.Nil(err)
+	assert.Equal(1, i)
+
+	i, err = Authoritative([]*FernetKeys{older, newer, newer}, StrategyMajority)
+	assert.Nil(err)
+	assert.Equal(1, i)
+
+	_, err = Authoritative([]*FernetKeys{older, newer}, StrategyMajority)
+	assert.NotNil(err, "No majority expected with two different keys")
+
+	other := rotated(t, older, 1)
+	_, err = Authoritative([]*FernetKeys{newer, other}, StrategyNewest)
+	assert.NotNil(err, "Different keys with the same creation time are expected to be ambiguous")
+
+	_, err = Authoritative([]*FernetKeys{older}, "oldest")
+	assert.NotNil(err)
+}
+
+func TestCheckRepair(t *testing.T) {
+	assert := assert.New(t)
+	older := fkeys.Copy()
+	newer := rotated(t, older, 1)
+	unrelated, err := NewFernetKeys(3600, 3)
+	assert.Nil(err)
+
+	assert.Nil(SafetyPolicy{}.CheckRepair(newer, older))
+	assert.NotNil(SafetyPolicy{}.CheckRepair(newer, unrelated), "Disjoint keys are expected to be refused")
+	assert.Nil(SafetyPolicy{AllowDisjoint: true, AllowNewer: true}.CheckRepair(newer, unrelated))
+	assert.NotNil(SafetyPolicy{}.CheckRepair(older, newer), "Newer keys are expected to be refused")
+	assert.Nil(SafetyPolicy{AllowNewer: true}.CheckRepair(older, newer))
+	assert.NotNil(SafetyPolicy{MaxDivergence: 1}.CheckRepair(rotated(t, older, 2), older))
+}
+
+func TestReconcile(t *testing.T) {
+	assert := assert.New(t)
+	older := fkeys.Copy()
+	newer := rotated(t, older, 1)
+	vaults, _, stop := newFakeVaults(t, 3, newer)
+	defer stop()
+	_, err := WriteFernetKeys(vaults[2], "secret/fernet-keys", older, 120, 0)
+	assert.Nil(err)
+
+	_, err = GetFernetKeys(vaults, "secret/fernet-keys")
+	assert.Equal(ErrKeysDiverged, err)
+
+	fk, repaired, err := Reconcile(vaults, "secret/fernet-keys", ReconcileOptions{Strategy: StrategyMajority}, 120)
+	assert.Nil(err)
+	assert.Equal(newer, fk)
+	assert.Equal([]string{vaults[2].Name()}, repaired)
+
+	fk, err = GetFernetKeys(vaults, "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(newer, fk)
+}
+
+func TestReconcileRefused(t *testing.T) {
+	assert := assert.New(t)
+	unrelated, err := NewFernetKeys(3600, 3)
+	assert.Nil(err)
+	vaults, _, stop := newFakeVaults(t, 2, &fkeys)
+	defer stop()
+	_, err = WriteFernetKeys(vaults[1], "secret/fernet-keys", unrelated, 120, 0)
+	assert.Nil(err)
+
+	_, repaired, err := Reconcile(vaults, "secret/fernet-keys", ReconcileOptions{Strategy: StrategyPrimary}, 120)
+	assert.NotNil(err)
+	assert.Empty(repaired)
+	fk, err := ReadFernetKeys(vaults[1], "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(unrelated, fk, "Disjoint keys are not expected to be repaired")
+}
+
+func TestDecideReconcile(t *testing.T) {
+	assert := assert.New(t)
+	older := fkeys.Copy()
+	newer := rotated(t, older, 1)
+	vaults, _, stop := newFakeVaults(t, 3, newer)
+	defer stop()
+	_, err := WriteFernetKeys(vaults[1], "secret/fernet-keys", older, 120, 0)
+	assert.Nil(err)
+
+	r, err := DecideReconcile(vaults, "secret/fernet-keys", ReconcileOptions{Strategy: StrategyPrimary})
+	assert.Nil(err)
+	assert.Equal(0, r.Source)
+	assert.Equal(newer, r.Authoritative)
+	assert.Equal([]int{1}, r.Lagging)
+	assert.Equal(older, r.Keysets[1])
+
+	fk, err := ReadFernetKeys(vaults[1], "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(older, fk, "Nothing is expected to be written when deciding")
+}
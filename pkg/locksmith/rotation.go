@@ -0,0 +1,121 @@
+package locksmith
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VaultState is the state of a Vault after a rotation attempt
+type VaultState int
+
+const (
+	// StateUnchanged means that the Vault still holds the previous keys
+	StateUnchanged VaultState = iota
+	// StateRotated means that the Vault holds the new keys
+	StateRotated
+	// StateRolledBack means that the new keys were written then replaced by the previous keys
+	StateRolledBack
+	// StateUnknown means that the new keys were written and could not be rolled back
+	StateUnknown
+)
+
+func (s VaultState) String() string {
+	switch s {
+	case StateUnchanged:
+		return "unchanged"
+	case StateRotated:
+		return "rotated"
+	case StateRolledBack:
+		return "rolled back"
+	default:
+		return "unknown"
+	}
+}
+
+// VaultResult holds the state of one Vault after a rotation attempt
+type VaultResult struct {
+	Vault string
+	State VaultState
+	Err   error // Error that happened while writing to or rolling back this Vault
+}
+
+// RotationError is returned when new keys could not be committed to every Vault.
+// It reports the state each Vault ended up in.
+type RotationError struct {
+	Err     error
+	Results []VaultResult
+}
+
+func (e *RotationError) Error() string {
+	states := make([]string, len(e.Results))
+	for i, r := range e.Results {
+		states[i] = fmt.Sprintf("%s: %s", r.Vault, r.State)
+		if r.Err != nil {
+			states[i] += fmt.Sprintf(" (%v)", r.Err)
+		}
+	}
+	return fmt.Sprintf("%v. Vault states: %s", e.Err, strings.Join(states, ", "))
+}
+
+// Consistent returns true if every Vault ended up holding the same keys
+func (e *RotationError) Consistent() bool {
+	for _, r := range e.Results {
+		if r.State == StateRotated || r.State == StateUnknown {
+			return false
+		}
+	}
+	return true
+}
+
+// CommitFernetKeys writes new fernet keys to every Vault in two phases.
+// The new keys are first staged: every Vault is read again to check that it
+// still holds the previous keys, and to get the version of the secret used for
+// check-and-set writes. The new keys are then committed to each Vault.
+// If a write fails, the previous keys are restored in the Vaults already written.
+// A *RotationError reporting the state of each Vault is returned on failure.
+func CommitFernetKeys(vlist []Store, path string, previous, next *FernetKeys, ttl int) error {
+	results := make([]VaultResult, len(vlist))
+	for i, v := range vlist {
+		results[i] = VaultResult{Vault: v.Name(), State: StateUnchanged}
+	}
+
+	// Stage
+	versions := make([]int, len(vlist))
+	for i, v := range vlist {
+		fkeys, version, err := ReadFernetKeysVersion(v, path)
+		if err != nil {
+			results[i].Err = err
+			return &RotationError{Err: fmt.Errorf("Cannot stage keys in %s", results[i].Vault), Results: results}
+		}
+		if !fkeys.Equal(previous) {
+			return &RotationError{Err: fmt.Errorf("Cannot stage keys: keys in %s changed since they were read", results[i].Vault), Results: results}
+		}
+		versions[i] = version
+	}
+
+	// Commit
+	for i, v := range vlist {
+		version, err := WriteFernetKeys(v, path, next, ttl, versions[i])
+		if err != nil {
+			results[i].Err = err
+			rollback(vlist[:i], versions[:i], results[:i], path, previous, ttl)
+			return &RotationError{Err: fmt.Errorf("Cannot commit keys to %s", results[i].Vault), Results: results}
+		}
+		versions[i] = version
+		results[i].State = StateRotated
+	}
+	return nil
+}
+
+// rollback restores the previous keys in Vaults where new keys were written.
+// versions holds the versions of the secrets written.
+func rollback(vlist []Store, versions []int, results []VaultResult, path string, previous *FernetKeys, ttl int) {
+	for i, v := range vlist {
+		if _, err := WriteFernetKeys(v, path, previous, ttl, versions[i]); err != nil {
+			results[i].State = StateUnknown
+			results[i].Err = fmt.Errorf("rollback failed: %v", err)
+			continue
+		}
+		results[i].State = StateRolledBack
+	}
+}
@@ -0,0 +1,265 @@
+package locksmith
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
+)
+
+// fakeKVServer is a minimal stand-in for a Vault server with a KV version 1 mount
+type fakeKVServer struct {
+	mu           sync.Mutex
+	secrets      map[string]json.RawMessage
+	acceptWrites int // Number of writes to accept before rejecting them, -1 accepts every write
+}
+
+func (f *fakeKVServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := r.URL.Path[len("/v1/"):]
+	switch r.Method {
+	case "GET":
+		s, ok := f.secrets[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": s})
+	case "PUT":
+		if f.acceptWrites == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		if f.acceptWrites > 0 {
+			f.acceptWrites--
+		}
+		var s json.RawMessage
+		json.NewDecoder(r.Body).Decode(&s)
+		f.secrets[path] = s
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(f.secrets, path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// memStore is an in-memory store keeping versions of secrets, like a KV version 2 mount
+type memStore struct {
+	mu       sync.Mutex
+	name     string
+	secrets  map[string][]byte
+	versions map[string]int
+	// onReadVersion, if set, is called after each ReadVersion
+	onReadVersion func()
+}
+
+func newMemStore(name string) *memStore {
+	return &memStore{name: name, secrets: map[string][]byte{}, versions: map[string]int{}}
+}
+
+func (m *memStore) Name() string { return m.name }
+
+func (m *memStore) Read(path string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.secrets[path], nil
+}
+
+func (m *memStore) ReadVersion(path string) ([]byte, int, error) {
+	m.mu.Lock()
+	b, version := m.secrets[path], m.versions[path]
+	m.mu.Unlock()
+	if m.onReadVersion != nil {
+		m.onReadVersion()
+	}
+	return b, version, nil
+}
+
+func (m *memStore) Write(path string, data map[string]interface{}, version int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.versions[path] != version {
+		return 0, ErrCASMismatch
+	}
+	b, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return 0, err
+	}
+	m.secrets[path] = b
+	m.versions[path]++
+	return m.versions[path], nil
+}
+
+func (m *memStore) Delete(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.secrets, path)
+	delete(m.versions, path)
+	return nil
+}
+
+// newFakeVaults starts n fake Vault servers holding the same fernet keys
+func newFakeVaults(t *testing.T, n int, fk *FernetKeys) ([]Store, []*fakeKVServer, func()) {
+	var vaults []Store
+	var kvs []*fakeKVServer
+	var servers []*httptest.Server
+	for i := 0; i < n; i++ {
+		kv := &fakeKVServer{secrets: map[string]json.RawMessage{}, acceptWrites: -1}
+		srv := httptest.NewServer(kv)
+		v, err := vault.NewClient(srv.URL, "", nil, false)
+		if err != nil {
+			t.Fatalf("Error creating vault client: %v", err)
+		}
+		v.Client.SetToken("test")
+		v.Client.SetMaxRetries(0)
+		if fk != nil {
+			if _, err := WriteFernetKeys(v, "secret/fernet-keys", fk, 120, 0); err != nil {
+				t.Fatalf("Error writing keys: %v", err)
+			}
+		}
+		vaults = append(vaults, v)
+		kvs = append(kvs, kv)
+		servers = append(servers, srv)
+	}
+	return vaults, kvs, func() {
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+}
+
+func TestCommitFernetKeys(t *testing.T) {
+	assert := assert.New(t)
+	vaults, _, stop := newFakeVaults(t, 3, &fkeys)
+	defer stop()
+
+	previous := fkeys.Copy()
+	next := fkeys.Copy()
+	assert.Nil(next.Rotate(0))
+
+	assert.Nil(CommitFernetKeys(vaults, "secret/fernet-keys", previous, next, 120))
+	for _, v := range vaults {
+		fk, err := ReadFernetKeys(v, "secret/fernet-keys")
+		assert.Nil(err)
+		assert.Equal(next, fk, "Every vault is expected to hold the new keys")
+	}
+}
+
+func TestCommitFernetKeysRollback(t *testing.T) {
+	assert := assert.New(t)
+	vaults, kvs, stop := newFakeVaults(t, 3, &fkeys)
+	defer stop()
+	kvs[2].acceptWrites = 0
+
+	previous := fkeys.Copy()
+	next := fkeys.Copy()
+	assert.Nil(next.Rotate(0))
+
+	err := CommitFernetKeys(vaults, "secret/fernet-keys", previous, next, 120)
+	rerr, ok := err.(*RotationError)
+	if !ok {
+		t.Fatalf("RotationError expected, got %v", err)
+	}
+	assert.True(rerr.Consistent())
+	assert.Equal(StateRolledBack, rerr.Results[0].State)
+	assert.Equal(StateRolledBack, rerr.Results[1].State)
+	assert.Equal(StateUnchanged, rerr.Results[2].State)
+	assert.NotNil(rerr.Results[2].Err)
+	for _, v := range vaults {
+		fk, err := ReadFernetKeys(v, "secret/fernet-keys")
+		assert.Nil(err)
+		assert.Equal(previous, fk, "Every vault is expected to hold the previous keys")
+	}
+}
+
+func TestCommitFernetKeysRollbackFailure(t *testing.T) {
+	assert := assert.New(t)
+	vaults, kvs, stop := newFakeVaults(t, 2, &fkeys)
+	defer stop()
+
+	previous := fkeys.Copy()
+	next := fkeys.Copy()
+	assert.Nil(next.Rotate(0))
+
+	// The first vault accepts the new keys then rejects the rollback
+	kvs[0].acceptWrites = 1
+	kvs[1].acceptWrites = 0
+
+	err := CommitFernetKeys(vaults, "secret/fernet-keys", previous, next, 120)
+	rerr, ok := err.(*RotationError)
+	if !ok {
+		t.Fatalf("RotationError expected, got %v", err)
+	}
+	assert.False(rerr.Consistent())
+	assert.Equal(StateUnknown, rerr.Results[0].State)
+	assert.Equal(StateUnchanged, rerr.Results[1].State)
+	assert.Contains(rerr.Error(), "unknown")
+}
+
+func TestCommitFernetKeysStaging(t *testing.T) {
+	assert := assert.New(t)
+	vaults, _, stop := newFakeVaults(t, 2, &fkeys)
+	defer stop()
+
+	previous := fkeys.Copy()
+	next := fkeys.Copy()
+	assert.Nil(next.Rotate(0))
+
+	// Another locksmith rotated the second vault since keys were read
+	other := fkeys.Copy()
+	assert.Nil(other.Rotate(0))
+	_, err := WriteFernetKeys(vaults[1], "secret/fernet-keys", other, 120, 0)
+	assert.Nil(err)
+
+	err = CommitFernetKeys(vaults, "secret/fernet-keys", previous, next, 120)
+	rerr, ok := err.(*RotationError)
+	if !ok {
+		t.Fatalf("RotationError expected, got %v", err)
+	}
+	assert.Equal(StateUnchanged, rerr.Results[0].State)
+	fk, err := ReadFernetKeys(vaults[0], "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(previous, fk, "Nothing is expected to be written when staging fails")
+}
+
+func TestCommitFernetKeysInterleavedRead(t *testing.T) {
+	assert := assert.New(t)
+	stores := []*memStore{newMemStore("a"), newMemStore("b")}
+	for _, m := range stores {
+		_, err := WriteFernetKeys(m, "secret/fernet-keys", &fkeys, 120, 0)
+		assert.Nil(err)
+	}
+
+	previous := fkeys.Copy()
+	next := fkeys.Copy()
+	assert.Nil(next.Rotate(0))
+	other := fkeys.Copy()
+	assert.Nil(other.Rotate(0))
+
+	// Once the first store is staged, another locksmith rotates it and a health
+	// check reads it before the keys are committed
+	stores[1].onReadVersion = func() {
+		_, version, _ := stores[0].ReadVersion("secret/fernet-keys")
+		_, err := WriteFernetKeys(stores[0], "secret/fernet-keys", other, 120, version)
+		assert.Nil(err)
+		_, err = ReadFernetKeys(stores[0], "secret/fernet-keys")
+		assert.Nil(err)
+	}
+
+	err := CommitFernetKeys([]Store{stores[0], stores[1]}, "secret/fernet-keys", previous, next, 120)
+	rerr, ok := err.(*RotationError)
+	if !ok {
+		t.Fatalf("RotationError expected, got %v", err)
+	}
+	assert.Equal(StateUnchanged, rerr.Results[0].State)
+	fk, err := ReadFernetKeys(stores[0], "secret/fernet-keys")
+	assert.Nil(err)
+	assert.Equal(other, fk, "The keys of the other locksmith are not expected to be overwritten")
+}
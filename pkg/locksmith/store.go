@@ -0,0 +1,50 @@
+package locksmith
+
+import (
+	"time"
+
+	"github.com/aevox/vault-fernet-locksmith/pkg/vault"
+)
+
+// ErrCASMismatch is returned by stores when a check-and-set write is rejected
+// because the secret has been modified since it was read
+var ErrCASMismatch = vault.ErrCASMismatch
+
+// Reader reads secrets from a store
+type Reader interface {
+	// Read returns the secret at path in the {"data": {...}} shape of the Vault API,
+	// or nil if there is no secret at path
+	Read(path string) ([]byte, error)
+}
+
+// Writer writes secrets to a store
+type Writer interface {
+	// Write replaces the secret at path with data if the secret is still at version,
+	// as returned by ReadVersion, and returns its new version. It returns
+	// ErrCASMismatch if the secret has been modified in between. Stores that do not
+	// keep versions of secrets ignore version and return 0.
+	Write(path string, data map[string]interface{}, version int) (int, error)
+}
+
+// Store is a backend holding fernet keys secrets, like a Vault.
+// Every command operates on a list of stores, which can mix backends.
+type Store interface {
+	Reader
+	Writer
+	// ReadVersion returns the secret at path like Read, along with its version, to
+	// give to Write. The version is 0 if there is no secret at path or if the store
+	// does not keep versions of secrets.
+	ReadVersion(path string) ([]byte, int, error)
+	// Delete deletes the secret at path
+	Delete(path string) error
+	// Name identifies the store in logs, plans and reports
+	Name() string
+}
+
+// Watcher is implemented by stores able to notify the changes of a secret, so that
+// readers do not have to poll them
+type Watcher interface {
+	// Watch blocks until the secret at path is modified after index, or until wait
+	// elapses. It returns the index to give to the next call: 0 returns immediately.
+	Watch(path string, index uint64, wait time.Duration) (uint64, error)
+}
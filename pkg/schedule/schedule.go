@@ -0,0 +1,190 @@
+package schedule
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the times at which something happens
+type Schedule interface {
+	// Next returns the first time of the schedule strictly after t,
+	// or the zero time if there is none
+	Next(t time.Time) time.Time
+}
+
+var dailyRegexp = regexp.MustCompile(`^daily at (\d{1,2}):(\d{2})(?: in (\S+))?$`)
+
+// Parse parses a schedule, either a cron expression or "daily at HH:MM in Zone".
+// Cron expressions may be prefixed with CRON_TZ=Zone. Times are evaluated in loc
+// unless the schedule sets its own time zone. A nil loc means UTC.
+func Parse(spec string, loc *time.Location) (Schedule, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	spec = strings.TrimSpace(spec)
+
+	if m := dailyRegexp.FindStringSubmatch(strings.ToLower(spec)); m != nil {
+		hour, _ := strconv.Atoi(m[1])
+		minute, _ := strconv.Atoi(m[2])
+		if hour > 23 || minute > 59 {
+			return nil, fmt.Errorf("Invalid time in schedule %q", spec)
+		}
+		if m[3] != "" {
+			// Time zone names are case sensitive
+			var err error
+			if loc, err = time.LoadLocation(strings.Fields(spec)[4]); err != nil {
+				return nil, fmt.Errorf("Invalid time zone in schedule %q: %v", spec, err)
+			}
+		}
+		return parseCron(fmt.Sprintf("%d %d * * *", minute, hour), loc)
+	}
+
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		parts := strings.SplitN(spec, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid schedule %q", spec)
+		}
+		var err error
+		if loc, err = time.LoadLocation(parts[0][strings.Index(parts[0], "=")+1:]); err != nil {
+			return nil, fmt.Errorf("Invalid time zone in schedule %q: %v", spec, err)
+		}
+		spec = parts[1]
+	}
+	return parseCron(spec, loc)
+}
+
+// Window is a period of time during which rotations are not allowed.
+// It is either recurring, starting at each time of a schedule, or a single period.
+type Window struct {
+	Start    Schedule      // Start of a recurring window
+	Duration time.Duration // Duration of a recurring window
+	From     time.Time     // Start of a single window
+	To       time.Time     // End of a single window
+}
+
+// Active returns true if t is in the window, and the end of the window
+func (w Window) Active(t time.Time) (bool, time.Time) {
+	if w.Start == nil {
+		if !t.Before(w.From) && t.Before(w.To) {
+			return true, w.To
+		}
+		return false, time.Time{}
+	}
+
+	// The window is active if it started less than its duration ago.
+	// Overlapping occurrences extend it.
+	var end time.Time
+	for start := w.Start.Next(t.Add(-w.Duration)); !start.IsZero() && !start.After(t); start = w.Start.Next(start) {
+		end = start.Add(w.Duration)
+	}
+	if end.After(t) {
+		return true, end
+	}
+	return false, time.Time{}
+}
+
+// blackoutHorizon bounds the search for the end of blackout windows, which never
+// end when the occurrences of a recurring window overlap
+const blackoutHorizon = 366 * 24 * time.Hour
+
+// Overlaps returns true if, within a year after from, an occurrence of a recurring
+// window starts before the previous one ends. Such a window may never end.
+func (w Window) Overlaps(from time.Time) bool {
+	if w.Start == nil {
+		return false
+	}
+	horizon := from.Add(blackoutHorizon)
+	for start := w.Start.Next(from); !start.IsZero() && start.Before(horizon); {
+		next := w.Start.Next(start)
+		if !next.IsZero() && next.Sub(start) <= w.Duration {
+			return true
+		}
+		start = next
+	}
+	return false
+}
+
+// Decision tells whether keys must be rotated
+type Decision struct {
+	Rotate   bool      // Keys must be rotated now
+	Due      time.Time // Time the keys are due for rotation
+	Deferred time.Time // Time the rotation is deferred to, if it is in a blackout window
+	Forced   bool      // The rotation happens in a blackout window to honor the maximum deferral or age
+}
+
+// Policy decides when keys are rotated
+type Policy struct {
+	Schedule    Schedule      // Times keys are rotated at. Keys are rotated after their period when it is nil.
+	Blackouts   []Window      // Windows during which rotations are deferred
+	MaxDeferral time.Duration // Maximum time a rotation can be deferred by blackouts, 0 means no limit
+	MaxAge      time.Duration // Maximum age of the keys, 0 means no limit
+}
+
+// Due returns the time keys created at creation with a period of rotation are due.
+// Without a schedule, keys are due lead before the end of their period, so that the
+// rotation happens on the last poll before it ends. With a schedule, keys are due
+// at the first time of the schedule from that time, so their period is never shortened.
+func (p *Policy) Due(creation time.Time, period, lead time.Duration) time.Time {
+	due := creation.Add(period - lead)
+	if p.Schedule != nil {
+		// Schedules have a precision of a minute
+		due = p.Schedule.Next(due.Add(-time.Minute))
+	}
+	if p.MaxAge > 0 && (due.IsZero() || creation.Add(p.MaxAge-lead).Before(due)) {
+		due = creation.Add(p.MaxAge - lead)
+	}
+	return due
+}
+
+// Decide tells whether keys created at creation with a period of rotation must be rotated at now
+func (p *Policy) Decide(creation time.Time, period, lead time.Duration, now time.Time) Decision {
+	d := Decision{Due: p.Due(creation, period, lead)}
+	if d.Due.IsZero() || now.Before(d.Due) {
+		return d
+	}
+
+	end := p.blackoutEnd(now)
+	if end.IsZero() {
+		d.Rotate = true
+		return d
+	}
+	// Keys are rotated in a blackout window rather than exceed their maximum age or deferral
+	limit := end
+	if p.MaxDeferral > 0 && d.Due.Add(p.MaxDeferral).Before(limit) {
+		limit = d.Due.Add(p.MaxDeferral)
+	}
+	if p.MaxAge > 0 && creation.Add(p.MaxAge-lead).Before(limit) {
+		limit = creation.Add(p.MaxAge - lead)
+	}
+	if limit.Before(end) && !now.Before(limit) {
+		d.Rotate = true
+		d.Forced = true
+		return d
+	}
+	d.Deferred = end
+	return d
+}
+
+// blackoutEnd returns the end of the blackout windows active at t, or the zero time.
+// Windows ending more than a year after t are not searched further.
+func (p *Policy) blackoutEnd(t time.Time) time.Time {
+	var end time.Time
+	// Adjacent or overlapping windows are merged
+	for active := true; active && end.Sub(t) < blackoutHorizon; {
+		active = false
+		for _, w := range p.Blackouts {
+			at := t
+			if !end.IsZero() {
+				at = end
+			}
+			if ok, e := w.Active(at); ok && e.After(end) {
+				end = e
+				active = true
+			}
+		}
+	}
+	return end
+}
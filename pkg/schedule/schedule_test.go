@@ -0,0 +1,155 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParse(t *testing.T, spec string) Schedule {
+	s, err := Parse(spec, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestCron(t *testing.T) {
+	tests := []struct {
+		spec, from, next string
+	}{
+		{"*/15 * * * *", "2019-03-01T10:07:00Z", "2019-03-01T10:15:00Z"},
+		{"0 3 * * *", "2019-03-01T03:00:00Z", "2019-03-02T03:00:00Z"},
+		{"30 2 * * mon-fri", "2019-03-01T03:00:00Z", "2019-03-04T02:30:00Z"},
+		{"0 0 1 jan,jul *", "2019-03-01T00:00:00Z", "2019-07-01T00:00:00Z"},
+		{"0 0 29 2 *", "2019-03-01T00:00:00Z", "2020-02-29T00:00:00Z"},
+		// Day of month or day of week when both are restricted
+		{"0 12 13 * 5", "2019-03-01T13:00:00Z", "2019-03-08T12:00:00Z"},
+		{"0 0 * * 7", "2019-03-01T00:00:00Z", "2019-03-03T00:00:00Z"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, date(tt.next), mustParse(t, tt.spec).Next(date(tt.from)).UTC(), tt.spec)
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		_, err := Parse(spec, nil)
+		assert.NotNil(t, err, spec)
+	}
+	assert.True(t, mustParse(t, "0 0 30 2 *").Next(date("2019-03-01T00:00:00Z")).IsZero())
+}
+
+func TestDaily(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("time zone database not available")
+	}
+	s := mustParse(t, "daily at 03:30 in Europe/Paris")
+	// Paris is UTC+1 in winter and UTC+2 in summer
+	assert.Equal(t, date("2019-03-02T02:30:00Z"), s.Next(date("2019-03-01T03:00:00Z")).UTC())
+	assert.Equal(t, date("2019-04-02T01:30:00Z"), s.Next(date("2019-04-01T03:00:00Z")).UTC())
+
+	s, err = Parse("daily at 03:30", paris)
+	assert.Nil(t, err)
+	assert.Equal(t, date("2019-03-02T02:30:00Z"), s.Next(date("2019-03-01T03:00:00Z")).UTC())
+
+	s = mustParse(t, "CRON_TZ=Europe/Paris 30 3 * * *")
+	assert.Equal(t, date("2019-03-02T02:30:00Z"), s.Next(date("2019-03-01T03:00:00Z")).UTC())
+
+	_, err = Parse("daily at 25:00", nil)
+	assert.NotNil(t, err)
+	_, err = Parse("daily at 03:00 in Nowhere/Atlantis", nil)
+	assert.NotNil(t, err)
+}
+
+func TestWindow(t *testing.T) {
+	// Every friday from 18:00 to monday 06:00
+	weekend := Window{Start: mustParse(t, "0 18 * * fri"), Duration: 60 * time.Hour}
+	ok, end := weekend.Active(date("2019-03-02T12:00:00Z"))
+	assert.True(t, ok)
+	assert.Equal(t, date("2019-03-04T06:00:00Z"), end)
+	ok, _ = weekend.Active(date("2019-03-04T06:00:00Z"))
+	assert.False(t, ok)
+
+	freeze := Window{From: date("2019-12-20T00:00:00Z"), To: date("2020-01-03T00:00:00Z")}
+	ok, end = freeze.Active(date("2019-12-25T00:00:00Z"))
+	assert.True(t, ok)
+	assert.Equal(t, freeze.To, end)
+	ok, _ = freeze.Active(date("2020-01-03T00:00:00Z"))
+	assert.False(t, ok)
+}
+
+func TestDecide(t *testing.T) {
+	creation := date("2019-03-01T12:00:00Z")
+	period := 24 * time.Hour
+	lead := 2 * time.Minute
+
+	p := &Policy{}
+	assert.False(t, p.Decide(creation, period, lead, date("2019-03-02T11:00:00Z")).Rotate)
+	assert.True(t, p.Decide(creation, period, lead, date("2019-03-02T11:58:00Z")).Rotate)
+
+	// Keys are rotated at the first time of the schedule after their period
+	p = &Policy{Schedule: mustParse(t, "daily at 03:00")}
+	d := p.Decide(creation, period, lead, date("2019-03-03T02:59:00Z"))
+	assert.False(t, d.Rotate)
+	assert.Equal(t, date("2019-03-03T03:00:00Z"), d.Due)
+	assert.True(t, p.Decide(creation, period, lead, date("2019-03-03T03:00:00Z")).Rotate)
+	assert.Equal(t, date("2019-03-09T03:00:00Z"), p.Due(creation, 7*24*time.Hour, lead))
+	assert.Equal(t, date("2019-03-02T03:00:00Z"), p.Due(date("2019-03-01T03:02:00Z"), period, lead), "A time of the schedule at the end of the period is expected to be due")
+
+	// Saturday 2019-03-02 is in the weekend freeze
+	p = &Policy{Blackouts: []Window{{Start: mustParse(t, "0 18 * * fri"), Duration: 60 * time.Hour}}}
+	d = p.Decide(creation, period, lead, date("2019-03-02T12:00:00Z"))
+	assert.False(t, d.Rotate)
+	assert.Equal(t, date("2019-03-04T06:00:00Z"), d.Deferred)
+	assert.True(t, p.Decide(creation, period, lead, date("2019-03-04T06:00:00Z")).Rotate)
+
+	p.MaxDeferral = 12 * time.Hour
+	assert.False(t, p.Decide(creation, period, lead, date("2019-03-02T23:00:00Z")).Rotate)
+	d = p.Decide(creation, period, lead, date("2019-03-02T23:58:00Z"))
+	assert.True(t, d.Rotate)
+	assert.True(t, d.Forced)
+
+	p.MaxDeferral = 0
+	p.MaxAge = 36 * time.Hour
+	d = p.Decide(creation, period, lead, date("2019-03-02T23:58:00Z"))
+	assert.True(t, d.Rotate)
+	assert.True(t, d.Forced)
+}
+
+func TestBlackoutMerge(t *testing.T) {
+	p := &Policy{Blackouts: []Window{
+		{From: date("2019-03-01T00:00:00Z"), To: date("2019-03-02T00:00:00Z")},
+		{From: date("2019-03-02T00:00:00Z"), To: date("2019-03-03T00:00:00Z")},
+	}}
+	assert.Equal(t, date("2019-03-03T00:00:00Z"), p.blackoutEnd(date("2019-03-01T12:00:00Z")))
+}
+
+func TestBlackoutNeverEnds(t *testing.T) {
+	// Adjacent hourly windows are always active
+	hourly := Window{Start: mustParse(t, "0 * * * *"), Duration: time.Hour}
+	assert.True(t, hourly.Overlaps(date("2019-03-01T00:00:00Z")))
+	assert.False(t, Window{Start: mustParse(t, "0 * * * *"), Duration: 59 * time.Minute}.Overlaps(date("2019-03-01T00:00:00Z")))
+	assert.False(t, Window{Start: mustParse(t, "0 18 * * fri"), Duration: 60 * time.Hour}.Overlaps(date("2019-03-01T00:00:00Z")))
+
+	p := &Policy{Blackouts: []Window{hourly}}
+	done := make(chan Decision, 1)
+	go func() {
+		done <- p.Decide(date("2019-03-01T12:00:00Z"), 24*time.Hour, 2*time.Minute, date("2019-03-02T12:00:00Z"))
+	}()
+	select {
+	case d := <-done:
+		assert.False(t, d.Rotate)
+		assert.False(t, d.Deferred.Before(date("2020-03-02T12:00:00Z")), "The end of a blackout is expected to be searched for a year")
+	case <-time.After(3 * time.Second):
+		t.Fatal("Deciding in a blackout window that never ends is expected to return")
+	}
+}
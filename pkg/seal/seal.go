@@ -0,0 +1,92 @@
+// Package seal encrypts the secrets kept outside of Vault with AES-256-GCM.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// KeySize is the size of the keys used to seal secrets, for AES-256
+const KeySize = 32
+
+// ErrOpen is returned when a sealed secret cannot be decrypted or authenticated
+var ErrOpen = errors.New("Cannot open sealed secret: wrong key or tampered data")
+
+// Sealer encrypts and authenticates secrets with AES-256-GCM
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// New creates a sealer using a 32 bytes key
+func New(key []byte) (*Sealer, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("Key must be %d bytes long, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal encrypts plaintext with a random nonce. The additional data is authenticated
+// but not encrypted: the same data must be given to Open, which binds the sealed
+// secret to its context, like its path.
+func (s *Sealer) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("Cannot generate nonce: %v", err)
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts a secret sealed with the same key and additional data
+func (s *Sealer) Open(sealed, additionalData []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, ErrOpen
+	}
+	plaintext, err := s.aead.Open(nil, sealed[:n], sealed[n:], additionalData)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	return plaintext, nil
+}
+
+// DecodeKey decodes a base64 encoded key, in standard or URL-safe encoding
+func DecodeKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+		if key, err := enc.DecodeString(s); err == nil {
+			if len(key) != KeySize {
+				return nil, fmt.Errorf("Key must be %d bytes long, got %d", KeySize, len(key))
+			}
+			return key, nil
+		}
+	}
+	return nil, errors.New("Key is not base64 encoded")
+}
+
+// ReadKeyFile reads a base64 encoded key from a file
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read key file: %v", err)
+	}
+	key, err := DecodeKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key in %s: %v", path, err)
+	}
+	return key, nil
+}
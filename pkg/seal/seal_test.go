@@ -0,0 +1,75 @@
+package seal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeal(t *testing.T) {
+	assert := assert.New(t)
+	key := bytes.Repeat([]byte{1}, KeySize)
+	s, err := New(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := s.Seal([]byte("fernet keys"), []byte("secret/fernet-keys"))
+	assert.Nil(err)
+	assert.NotContains(string(sealed), "fernet keys")
+
+	again, err := s.Seal([]byte("fernet keys"), []byte("secret/fernet-keys"))
+	assert.Nil(err)
+	assert.NotEqual(sealed, again, "Nonces are expected to be random")
+
+	plaintext, err := s.Open(sealed, []byte("secret/fernet-keys"))
+	assert.Nil(err)
+	assert.Equal("fernet keys", string(plaintext))
+
+	_, err = s.Open(sealed, []byte("secret/other"))
+	assert.Equal(ErrOpen, err, "Additional data is expected to be authenticated")
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = s.Open(sealed, []byte("secret/fernet-keys"))
+	assert.Equal(ErrOpen, err)
+
+	_, err = s.Open([]byte("short"), nil)
+	assert.Equal(ErrOpen, err)
+
+	other, _ := New(bytes.Repeat([]byte{2}, KeySize))
+	_, err = other.Open(again, []byte("secret/fernet-keys"))
+	assert.Equal(ErrOpen, err)
+
+	_, err = New([]byte("too short"))
+	assert.NotNil(err)
+}
+
+func TestReadKeyFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "seal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte{0xfb}, KeySize)
+	path := filepath.Join(dir, "key")
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding} {
+		assert.Nil(ioutil.WriteFile(path, []byte(enc.EncodeToString(key)+"\n"), 0600))
+		k, err := ReadKeyFile(path)
+		assert.Nil(err)
+		assert.Equal(key, k)
+	}
+
+	assert.Nil(ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key[:16])), 0600))
+	_, err = ReadKeyFile(path)
+	assert.NotNil(err)
+
+	_, err = ReadKeyFile(filepath.Join(dir, "missing"))
+	assert.NotNil(err)
+}
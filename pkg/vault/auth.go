@@ -0,0 +1,167 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// Authenticator is implemented by the Vault auth methods locksmith can use to
+// obtain a token.
+type Authenticator interface {
+	// Login authenticates against Vault and returns the auth secret holding the new token
+	Login(client *vaultapi.Client) (*vaultapi.Secret, error)
+}
+
+// AppRoleAuth logs in to Vault using the AppRole auth method
+type AppRoleAuth struct {
+	Mount        string // Mount path of the auth method, defaults to approle
+	RoleID       string // Role ID of the AppRole
+	SecretID     string // Secret ID of the AppRole
+	SecretIDFile string // Path to file containing the secret ID. It is read on every login
+}
+
+// Login logs in to auth/<mount>/login with the role ID and secret ID
+func (a *AppRoleAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	if a.RoleID == "" {
+		return nil, errors.New("AppRole role ID is empty")
+	}
+	secretID := a.SecretID
+	if a.SecretIDFile != "" {
+		data, err := ioutil.ReadFile(a.SecretIDFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read AppRole secret ID file: %v", err)
+		}
+		secretID = strings.TrimSpace(string(data))
+	}
+	return login(client, mountOrDefault(a.Mount, "approle"), map[string]interface{}{
+		"role_id":   a.RoleID,
+		"secret_id": secretID,
+	})
+}
+
+// DefaultKubernetesJWTFile is where Kubernetes mounts the service account token of a pod
+const DefaultKubernetesJWTFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// KubernetesAuth logs in to Vault using the Kubernetes auth method
+type KubernetesAuth struct {
+	Mount   string // Mount path of the auth method, defaults to kubernetes
+	Role    string // Vault role bound to the service account
+	JWTFile string // Path to the service account token. It is read on every login
+}
+
+// Login logs in to auth/<mount>/login with the service account token
+func (a *KubernetesAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	if a.Role == "" {
+		return nil, errors.New("Kubernetes auth role is empty")
+	}
+	jwtFile := a.JWTFile
+	if jwtFile == "" {
+		jwtFile = DefaultKubernetesJWTFile
+	}
+	// Projected service account tokens are rotated by the kubelet, always use the latest one
+	data, err := ioutil.ReadFile(jwtFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read service account token file: %v", err)
+	}
+	return login(client, mountOrDefault(a.Mount, "kubernetes"), map[string]interface{}{
+		"role": a.Role,
+		"jwt":  strings.TrimSpace(string(data)),
+	})
+}
+
+// CertAuth logs in to Vault using the TLS certificate auth method.
+// The client certificate must be configured in the TLS configuration of the client.
+type CertAuth struct {
+	Mount string // Mount path of the auth method, defaults to cert
+	Name  string // Optional name of the certificate role to authenticate against
+}
+
+// Login logs in to auth/<mount>/login with the client certificate presented during the TLS handshake
+func (a *CertAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	data := map[string]interface{}{}
+	if a.Name != "" {
+		data["name"] = a.Name
+	}
+	return login(client, mountOrDefault(a.Mount, "cert"), data)
+}
+
+// login writes the login data to auth/<mount>/login and checks that a token was returned
+func login(client *vaultapi.Client, mount string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	s, err := client.Logical().Write("auth/"+mount+"/login", data)
+	if err != nil {
+		return nil, fmt.Errorf("Error logging in to auth/%s: %v", mount, err)
+	}
+	if s == nil || s.Auth == nil || s.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("Error logging in to auth/%s: no token returned", mount)
+	}
+	return s, nil
+}
+
+func mountOrDefault(mount string, def string) string {
+	mount = strings.Trim(mount, "/")
+	if mount == "" {
+		return def
+	}
+	return mount
+}
+
+// Login authenticates with the configured auth method and sets the client token
+func (v *Vault) Login() error {
+	if v.Auth == nil {
+		return errors.New("No auth method configured")
+	}
+	s, err := v.Auth.Login(v.Client)
+	if err != nil {
+		return fmt.Errorf("Cannot log in to vault %s: %v", v.Client.Address(), err)
+	}
+	v.Client.SetToken(s.Auth.ClientToken)
+	v.setTokenExpiry(s.Auth.LeaseDuration)
+	return nil
+}
+
+// setTokenExpiry records when the client token expires. A lease duration of 0
+// means the token never expires.
+func (v *Vault) setTokenExpiry(leaseDuration int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if leaseDuration <= 0 {
+		v.tokenExpiry = time.Time{}
+		return
+	}
+	v.tokenExpiry = time.Now().Add(time.Duration(leaseDuration) * time.Second)
+}
+
+// tokenExpiresWithin returns true if the client token expires in less than d
+func (v *Vault) tokenExpiresWithin(d time.Duration) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return !v.tokenExpiry.IsZero() && time.Now().Add(d).After(v.tokenExpiry)
+}
+
+// KeepAlive keeps the client token valid. It renews the token if RenewToken is set.
+// When an auth method is configured, it logs in again if the token cannot be
+// renewed or if it expires in less than margin.
+func (v *Vault) KeepAlive(margin time.Duration) error {
+	var renewErr error
+	if v.RenewToken {
+		renewErr = v.SelfRenew()
+	}
+	if v.Auth == nil {
+		return renewErr
+	}
+	if renewErr == nil && !v.tokenExpiresWithin(margin) {
+		return nil
+	}
+	if err := v.Login(); err != nil {
+		if renewErr != nil {
+			return fmt.Errorf("%v, then %v", renewErr, err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAuth is a minimal stand-in for the login and token endpoints of a Vault server
+type fakeAuth struct {
+	mount     string
+	logins    int
+	loginData map[string]interface{}
+	ttl       int
+}
+
+func (f *fakeAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/auth/" + f.mount + "/login":
+		f.logins++
+		f.loginData = map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&f.loginData)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   fmt.Sprintf("token-%d", f.logins),
+				"lease_duration": f.ttl,
+				"renewable":      true,
+			},
+		})
+	case "/v1/auth/token/renew-self":
+		// The token reached its max TTL
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestAppRoleLogin(t *testing.T) {
+	assert := assert.New(t)
+	fa := &fakeAuth{mount: "approle", ttl: 3600}
+	v, srv := newTestVault(t, fa)
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "secret-id")
+	if err != nil {
+		t.Fatalf("Error creating secret ID file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("my-secret-id\n")
+	f.Close()
+
+	v.Auth = &AppRoleAuth{RoleID: "my-role-id", SecretIDFile: f.Name()}
+	assert.Nil(v.Login())
+	assert.Equal("token-1", v.Client.Token())
+	assert.Equal(map[string]interface{}{"role_id": "my-role-id", "secret_id": "my-secret-id"}, fa.loginData)
+
+	// Token is fresh, no new login expected
+	assert.Nil(v.KeepAlive(time.Minute))
+	assert.Equal(1, fa.logins)
+}
+
+func TestKeepAliveRelogin(t *testing.T) {
+	assert := assert.New(t)
+	fa := &fakeAuth{mount: "custom-approle", ttl: 30}
+	v, srv := newTestVault(t, fa)
+	defer srv.Close()
+
+	v.Auth = &AppRoleAuth{Mount: "custom-approle", RoleID: "my-role-id", SecretID: "my-secret-id"}
+	assert.Nil(v.Login())
+
+	// Token expires within the margin
+	assert.Nil(v.KeepAlive(time.Minute))
+	assert.Equal(2, fa.logins)
+	assert.Equal("token-2", v.Client.Token())
+
+	// Renewal fails
+	v.RenewToken = true
+	fa.ttl = 3600
+	assert.Nil(v.KeepAlive(time.Minute))
+	assert.Equal(3, fa.logins)
+}
+
+func TestKubernetesLogin(t *testing.T) {
+	assert := assert.New(t)
+	fa := &fakeAuth{mount: "kubernetes", ttl: 30}
+	v, srv := newTestVault(t, fa)
+	defer srv.Close()
+
+	f, err := ioutil.TempFile("", "jwt")
+	if err != nil {
+		t.Fatalf("Error creating service account token file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("first-jwt")
+	f.Close()
+
+	v.Auth = &KubernetesAuth{Role: "locksmith", JWTFile: f.Name()}
+	assert.Nil(v.Login())
+	assert.Equal("token-1", v.Client.Token())
+	assert.Equal(map[string]interface{}{"role": "locksmith", "jwt": "first-jwt"}, fa.loginData)
+
+	// The kubelet rotated the token, and the Vault token nears expiry
+	ioutil.WriteFile(f.Name(), []byte("second-jwt"), 0600)
+	assert.Nil(v.KeepAlive(time.Minute))
+	assert.Equal("token-2", v.Client.Token())
+	assert.Equal("second-jwt", fa.loginData["jwt"])
+}
+
+func TestKubernetesLoginMissingToken(t *testing.T) {
+	fa := &fakeAuth{mount: "kubernetes", ttl: 30}
+	v, srv := newTestVault(t, fa)
+	defer srv.Close()
+
+	v.Auth = &KubernetesAuth{Role: "locksmith", JWTFile: "/nonexistent/token"}
+	assert.NotNil(t, v.Login())
+	assert.Equal(t, 0, fa.logins)
+}
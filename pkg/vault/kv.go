@@ -0,0 +1,108 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// kvMount describes the KV secrets engine a secret path belongs to
+type kvMount struct {
+	Path    string // Mount path, with a trailing slash
+	Version int    // KV engine version (1 or 2)
+}
+
+// kvSecret is used to unmarshal a KV version 2 secret read from Vault
+type kvSecret struct {
+	Data struct {
+		Data     json.RawMessage `json:"data"`
+		Metadata json.RawMessage `json:"metadata"`
+	} `json:"data"`
+}
+
+// kvMetadata holds the KV version 2 metadata locksmith cares about
+type kvMetadata struct {
+	Version        int `json:"version"`
+	CurrentVersion int `json:"current_version"`
+}
+
+// mount returns the KV mount of a secret path. The result is cached so that
+// sys/internal/ui/mounts is only queried once per path.
+// Vaults that do not expose this endpoint, or do not allow the token to query it,
+// are considered to use KV version 1. Other errors are returned and not cached.
+func (v *Vault) mount(path string) (kvMount, error) {
+	v.mu.Lock()
+	m, ok := v.mounts[path]
+	v.mu.Unlock()
+	if ok {
+		return m, nil
+	}
+
+	m = kvMount{Version: 1}
+	resp, err := v.Client.RawRequest(v.Client.NewRequest("GET", "/v1/sys/internal/ui/mounts/"+path))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	switch {
+	case resp != nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound):
+	case err != nil:
+		return kvMount{}, fmt.Errorf("Error looking up the mount of secret %s: %v", path, err)
+	default:
+		s, err := vaultapi.ParseSecret(resp.Body)
+		if err != nil {
+			return kvMount{}, fmt.Errorf("Error decoding the mount of secret %s: %v", path, err)
+		}
+		if s != nil {
+			mountPath, _ := s.Data["path"].(string)
+			if options, ok := s.Data["options"].(map[string]interface{}); ok && options["version"] == "2" && mountPath != "" {
+				m = kvMount{Path: mountPath, Version: 2}
+			}
+		}
+	}
+
+	v.mu.Lock()
+	v.mounts[path] = m
+	v.mu.Unlock()
+	return m, nil
+}
+
+// dataPath returns the path used to read and write a secret
+func (m kvMount) dataPath(path string) string {
+	return m.prefixedPath(path, "data/")
+}
+
+// metadataPath returns the path of the metadata of a secret
+func (m kvMount) metadataPath(path string) string {
+	return m.prefixedPath(path, "metadata/")
+}
+
+func (m kvMount) prefixedPath(path string, prefix string) string {
+	if m.Version != 2 {
+		return path
+	}
+	return m.Path + prefix + strings.TrimPrefix(path, m.Path)
+}
+
+// currentVersion reads the current version of a KV version 2 secret in its metadata.
+// It returns 0 if the secret does not exist.
+func (v *Vault) currentVersion(m kvMount, path string) (int, error) {
+	s, err := v.Client.Logical().Read(m.metadataPath(path))
+	if err != nil {
+		return 0, fmt.Errorf("Error reading metadata of secret %s: %v", path, err)
+	}
+	if s == nil {
+		return 0, nil
+	}
+	b, err := json.Marshal(s.Data)
+	if err != nil {
+		return 0, fmt.Errorf("Error encoding metadata of secret %s: %v", path, err)
+	}
+	var md kvMetadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return 0, fmt.Errorf("Error decoding metadata of secret %s: %v", path, err)
+	}
+	return md.CurrentVersion, nil
+}
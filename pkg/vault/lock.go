@@ -0,0 +1,254 @@
+package vault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Default timings of a Lock
+const (
+	DefaultLockTTL       = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+)
+
+// Lock is a lock held by writing a lock document to a KV version 2 secret with
+// check-and-set. The document holds the owner of the lock and its expiry, which
+// the owner refreshes every retry period. Once expired, the lock is stale and
+// can be taken over by another instance.
+// The expiry is compared with the local clock: the clocks of the instances must
+// be synchronized much closer than the TTL of the lock.
+type Lock struct {
+	Vault         *Vault
+	Path          string        // Path of the lock document
+	Owner         string        // Identity of this instance, unique among instances
+	TTL           time.Duration // Time after which a lock that is not refreshed is stale
+	RenewDeadline time.Duration // Time the owner tries to refresh the lock before considering it lost
+	RetryPeriod   time.Duration // Interval between attempts to acquire or refresh the lock
+
+	mu          sync.Mutex
+	stopRefresh chan struct{}
+	refreshDone chan struct{}
+}
+
+// errNotKVv2 is returned when the lock document is not in a KV version 2 mount
+var errNotKVv2 = errors.New("Lock requires a KV version 2 mount")
+
+// lockDocument is the content of the secret holding a lock
+type lockDocument struct {
+	Owner    string `json:"owner"`
+	Acquired string `json:"acquired,omitempty"` // RFC 3339 time
+	Expires  string `json:"expires,omitempty"`  // RFC 3339 time
+}
+
+// NewLock creates a lock on the secret at path with the default timings
+func NewLock(v *Vault, path string, owner string) *Lock {
+	return &Lock{
+		Vault:         v,
+		Path:          path,
+		Owner:         owner,
+		TTL:           DefaultLockTTL,
+		RenewDeadline: DefaultRenewDeadline,
+		RetryPeriod:   DefaultRetryPeriod,
+	}
+}
+
+// Check returns an error if the lock is misconfigured
+func (l *Lock) Check() error {
+	if l.Path == "" {
+		return errors.New("Vault lock has no path")
+	}
+	if l.Owner == "" {
+		return errors.New("Vault lock has no owner")
+	}
+	if l.RenewDeadline <= 0 || l.RenewDeadline >= l.TTL {
+		return errors.New("Renew deadline must be positive and shorter than the lock TTL")
+	}
+	if l.RetryPeriod <= 0 || l.RetryPeriod >= l.RenewDeadline {
+		return errors.New("Retry period must be positive and shorter than the renew deadline")
+	}
+	return nil
+}
+
+// Name identifies the lock by its path and the address of the vault
+func (l *Lock) Name() string {
+	return l.Path + " in " + l.Vault.Name()
+}
+
+// Lock blocks until the lock is acquired or stopCh is closed. The lock is then
+// refreshed every retry period. The returned channel is closed when the lock could
+// not be refreshed before the renew deadline, or when another instance took it over.
+// The lock document must be in a KV version 2 mount.
+func (l *Lock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	if err := l.Check(); err != nil {
+		return nil, err
+	}
+	for {
+		ok, err := l.tryAcquireOrRefresh()
+		if err == errNotKVv2 {
+			return nil, fmt.Errorf("Lock %s requires a KV version 2 mount", l.Name())
+		}
+		if err != nil {
+			log.Debugf("Cannot acquire lock %s: %v", l.Name(), err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-stopCh:
+			return nil, nil
+		case <-time.After(l.RetryPeriod):
+		}
+	}
+
+	lostCh := make(chan struct{})
+	stop, done := make(chan struct{}), make(chan struct{})
+	l.mu.Lock()
+	l.stopRefresh, l.refreshDone = stop, done
+	l.mu.Unlock()
+	go l.refresh(stop, done, lostCh)
+	return lostCh, nil
+}
+
+// refresh refreshes the lock every retry period until stop is closed or the lock is lost
+func (l *Lock) refresh(stop <-chan struct{}, done chan<- struct{}, lostCh chan<- struct{}) {
+	defer close(done)
+	refreshed := time.Now()
+	tick := time.NewTicker(l.RetryPeriod)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+		ok, err := l.tryAcquireOrRefresh()
+		switch {
+		case ok:
+			refreshed = time.Now()
+			continue
+		case err == nil:
+			log.Warnf("Lock %s has been taken over", l.Name())
+		case time.Since(refreshed) < l.RenewDeadline:
+			log.Warnf("Cannot refresh lock %s: %v", l.Name(), err)
+			continue
+		default:
+			log.Warnf("Cannot refresh lock %s before the renew deadline: %v", l.Name(), err)
+		}
+		close(lostCh)
+		return
+	}
+}
+
+// read reads the lock document and its version. It returns nil if there is none.
+func (l *Lock) read() (*lockDocument, int, error) {
+	b, version, err := l.Vault.ReadVersion(l.Path)
+	if err != nil || b == nil {
+		return nil, version, err
+	}
+	var s struct {
+		Data *lockDocument `json:"data"`
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, 0, fmt.Errorf("Cannot decode lock %s: %v", l.Name(), err)
+	}
+	return s.Data, version, nil
+}
+
+// write writes the lock document with check-and-set on the version read
+func (l *Lock) write(doc *lockDocument, version int) error {
+	_, err := l.Vault.Write(l.Path, map[string]interface{}{
+		"owner":    doc.Owner,
+		"acquired": doc.Acquired,
+		"expires":  doc.Expires,
+	}, version)
+	return err
+}
+
+// held returns true if the lock document is held by an owner and not expired at now.
+// A document without a valid expiry is stale.
+func (doc *lockDocument) held(now time.Time) bool {
+	if doc == nil || doc.Owner == "" {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339Nano, doc.Expires)
+	return err == nil && now.Before(expires)
+}
+
+// tryAcquireOrRefresh acquires or refreshes the lock. It returns false without
+// error when the lock is held by another instance, and ErrCASMismatch when another
+// instance wrote the lock in between.
+func (l *Lock) tryAcquireOrRefresh() (bool, error) {
+	m, err := l.Vault.mount(l.Path)
+	if err != nil {
+		return false, err
+	}
+	if m.Version != 2 {
+		return false, errNotKVv2
+	}
+	doc, version, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if doc != nil && doc.Owner != l.Owner && doc.held(now) {
+		return false, nil
+	}
+
+	next := &lockDocument{
+		Owner:    l.Owner,
+		Acquired: now.UTC().Format(time.RFC3339Nano),
+		Expires:  now.Add(l.TTL).UTC().Format(time.RFC3339Nano),
+	}
+	if doc != nil && doc.Owner == l.Owner && doc.Acquired != "" {
+		next.Acquired = doc.Acquired
+	}
+	if err := l.write(next, version); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Unlock stops refreshing the lock and releases it, so that another instance can
+// acquire it without waiting for its expiry
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	stop, done := l.stopRefresh, l.refreshDone
+	l.stopRefresh, l.refreshDone = nil, nil
+	l.mu.Unlock()
+	if stop == nil {
+		return errors.New("Lock is not held")
+	}
+	close(stop)
+	<-done
+
+	doc, version, err := l.read()
+	if err != nil {
+		return fmt.Errorf("Cannot release lock %s: %v", l.Name(), err)
+	}
+	if doc == nil || doc.Owner != l.Owner {
+		return nil
+	}
+	if err := l.write(&lockDocument{Expires: time.Now().UTC().Format(time.RFC3339Nano)}, version); err != nil {
+		return fmt.Errorf("Cannot release lock %s: %v", l.Name(), err)
+	}
+	return nil
+}
+
+// Holder returns the owner of the lock, or an empty string if the lock is free
+// or stale
+func (l *Lock) Holder() (string, error) {
+	doc, _, err := l.read()
+	if err != nil {
+		return "", err
+	}
+	if !doc.held(time.Now()) {
+		return "", nil
+	}
+	return doc.Owner, nil
+}
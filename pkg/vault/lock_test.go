@@ -0,0 +1,236 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLockVault is a Vault server with a KV version 2 mount on secret/, safe for
+// concurrent use
+type fakeLockVault struct {
+	mu        sync.Mutex
+	documents map[string]map[string]interface{}
+	versions  map[string]int
+	forbidden bool
+}
+
+func newFakeLockVault() *fakeLockVault {
+	return &fakeLockVault{documents: map[string]map[string]interface{}{}, versions: map[string]int{}}
+}
+
+// document returns the document at path
+func (f *fakeLockVault) document(path string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.documents[path]
+}
+
+// put writes a document as if another instance wrote it
+func (f *fakeLockVault) put(path string, doc map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.documents[path] = doc
+	f.versions[path]++
+}
+
+func (f *fakeLockVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.forbidden {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/sys/internal/ui/mounts/"):
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"path": "secret/", "type": "kv", "options": map[string]interface{}{"version": "2"}},
+		})
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/") && r.Method == "GET":
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		doc, ok := f.documents[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"data": doc, "metadata": map[string]interface{}{"version": f.versions[path]}},
+		})
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/data/") && r.Method == "PUT":
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		var body struct {
+			Data    map[string]interface{} `json:"data"`
+			Options map[string]int         `json:"options"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if cas, ok := body.Options["cas"]; ok && cas != f.versions[path] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+			return
+		}
+		f.documents[path] = body.Data
+		f.versions[path]++
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"version": f.versions[path]}})
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/") && r.Method == "GET":
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")
+		if f.versions[path] == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"current_version": f.versions[path]}})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestLock(t *testing.T, f *fakeLockVault, owner string) (*Lock, func()) {
+	v, srv := newTestVault(t, f)
+	l := NewLock(v, "secret/locksmith/lock", owner)
+	l.TTL = time.Second
+	l.RenewDeadline = 500 * time.Millisecond
+	l.RetryPeriod = 50 * time.Millisecond
+	return l, srv.Close
+}
+
+// waitLock returns the result of Lock, or fails if the lock is not acquired before timeout
+func waitLock(t *testing.T, l *Lock, stopCh chan struct{}, timeout time.Duration) <-chan struct{} {
+	type result struct {
+		lostCh <-chan struct{}
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		lostCh, err := l.Lock(stopCh)
+		done <- result{lostCh, err}
+	}()
+	select {
+	case r := <-done:
+		assert.Nil(t, r.err)
+		return r.lostCh
+	case <-time.After(timeout):
+		t.Fatalf("%s is expected to acquire the lock within %s", l.Owner, timeout)
+	}
+	return nil
+}
+
+func TestLock(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeLockVault()
+	a, cleanupA := newTestLock(t, f, "a")
+	defer cleanupA()
+	b, cleanupB := newTestLock(t, f, "b")
+	defer cleanupB()
+	assert.Equal("secret/locksmith/lock in "+a.Vault.Name(), a.Name())
+
+	holder, err := b.Holder()
+	assert.Nil(err)
+	assert.Equal("", holder)
+
+	lostA := waitLock(t, a, nil, time.Second)
+	holder, err = b.Holder()
+	assert.Nil(err)
+	assert.Equal("a", holder)
+	acquired := f.document("locksmith/lock")["acquired"]
+
+	// b waits while a refreshes the lock, and acquires it as soon as it is released
+	stopB := make(chan struct{})
+	acquiredB := make(chan struct{})
+	go func() {
+		if lostCh, err := b.Lock(stopB); err == nil && lostCh != nil {
+			close(acquiredB)
+		}
+	}()
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case <-acquiredB:
+		t.Fatal("A refreshed lock is not expected to be taken over")
+	case <-lostA:
+		t.Fatal("A refreshed lock is not expected to be lost")
+	default:
+	}
+	assert.Equal(acquired, f.document("locksmith/lock")["acquired"], "Refreshing the lock is not expected to change its acquisition time")
+	assert.Nil(a.Unlock())
+	select {
+	case <-acquiredB:
+	case <-time.After(time.Second):
+		t.Fatal("A released lock is expected to be acquired")
+	}
+	assert.NotNil(a.Unlock(), "Unlocking a lock that is not held is expected to fail")
+	assert.Nil(b.Unlock())
+	holder, err = a.Holder()
+	assert.Nil(err)
+	assert.Equal("", holder)
+
+	// Lock returns when stopped before the lock is acquired
+	waitLock(t, a, nil, time.Second)
+	stop := make(chan struct{})
+	close(stop)
+	assert.Nil(waitLock(t, b, stop, time.Second))
+	assert.Nil(a.Unlock())
+}
+
+func TestLockExpiry(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeLockVault()
+	a, cleanupA := newTestLock(t, f, "a")
+	defer cleanupA()
+	b, cleanupB := newTestLock(t, f, "b")
+	defer cleanupB()
+
+	// a stops refreshing the lock without releasing it, as if it crashed
+	waitLock(t, a, nil, time.Second)
+	a.mu.Lock()
+	close(a.stopRefresh)
+	a.mu.Unlock()
+	start := time.Now()
+	lostB := waitLock(t, b, nil, 5*time.Second)
+	assert.True(time.Since(start) >= 500*time.Millisecond, "A stale lock is expected to be taken over after its expiry")
+	holder, err := a.Holder()
+	assert.Nil(err)
+	assert.Equal("b", holder)
+
+	// b loses the lock when another instance takes it over
+	f.put("locksmith/lock", map[string]interface{}{"owner": "c", "expires": time.Now().Add(time.Minute).Format(time.RFC3339Nano)})
+	select {
+	case <-lostB:
+	case <-time.After(time.Second):
+		t.Fatal("A lock taken over is expected to be lost")
+	}
+
+	// The owner loses the lock when it cannot refresh it before the renew deadline
+	f.put("locksmith/lock", map[string]interface{}{"owner": "c", "expires": "not a time"})
+	lostA := waitLock(t, a, nil, time.Second)
+	f.mu.Lock()
+	f.forbidden = true
+	f.mu.Unlock()
+	select {
+	case <-lostA:
+	case <-time.After(2 * time.Second):
+		t.Fatal("A lock that cannot be refreshed is expected to be lost")
+	}
+}
+
+func TestLockKVv1(t *testing.T) {
+	v, srv := newTestVault(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	lostCh, err := NewLock(v, "secret/locksmith/lock", "a").Lock(nil)
+	assert.NotNil(t, err, "A lock is expected to require a KV version 2 mount")
+	assert.Nil(t, lostCh)
+
+	for _, l := range []*Lock{
+		NewLock(v, "", "a"),
+		NewLock(v, "secret/locksmith/lock", ""),
+		{Vault: v, Path: "secret/locksmith/lock", Owner: "a", TTL: 10 * time.Second, RenewDeadline: 15 * time.Second, RetryPeriod: time.Second},
+		{Vault: v, Path: "secret/locksmith/lock", Owner: "a", TTL: 15 * time.Second, RenewDeadline: 10 * time.Second},
+	} {
+		assert.NotNil(t, l.Check())
+	}
+}
@@ -0,0 +1,57 @@
+package vault
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespace(t *testing.T) {
+	assert := assert.New(t)
+	kv := &fakeKVv2{}
+	fa := &fakeAuth{mount: "approle", ttl: 3600}
+	requests := map[string]string{}
+	v, srv := newTestVault(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.Method+" "+r.URL.Path] = r.Header.Get("X-Vault-Namespace")
+		switch r.URL.Path {
+		case "/v1/auth/approle/login", "/v1/auth/token/renew-self":
+			fa.ServeHTTP(w, r)
+		default:
+			kv.ServeHTTP(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	v.SetNamespace("/region-one/keystone/")
+	assert.Equal("region-one/keystone", v.Namespace())
+
+	v.Auth = &AppRoleAuth{RoleID: "my-role-id", SecretID: "my-secret-id"}
+	v.RenewToken = true
+	assert.Nil(v.Login())
+	v.SelfRenew()
+	v.Read("secret/fernet-keys")
+	_, err := v.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, 0)
+	assert.Nil(err)
+	assert.Nil(v.Delete("secret/fernet-keys"))
+
+	assert.Equal(map[string]string{
+		"PUT /v1/auth/approle/login":                        "region-one/keystone",
+		"PUT /v1/auth/token/renew-self":                     "region-one/keystone",
+		"GET /v1/sys/internal/ui/mounts/secret/fernet-keys": "region-one/keystone",
+		"GET /v1/secret/data/fernet-keys":                   "region-one/keystone",
+		"GET /v1/secret/metadata/fernet-keys":               "region-one/keystone",
+		"PUT /v1/secret/data/fernet-keys":                   "region-one/keystone",
+		"DELETE /v1/secret/metadata/fernet-keys":            "region-one/keystone",
+	}, requests, "Every request is expected to carry the namespace with a path relative to it")
+}
+
+func TestNoNamespace(t *testing.T) {
+	v, srv := newTestVault(t, http.NotFoundHandler())
+	defer srv.Close()
+
+	v.SetNamespace("")
+	assert.Equal(t, "", v.Namespace())
+	_, ok := v.Client.Headers()["X-Vault-Namespace"]
+	assert.False(t, ok, "Namespace header is not expected to be set")
+}
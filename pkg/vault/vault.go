@@ -2,20 +2,38 @@ package vault
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrCASMismatch is returned when a check-and-set write is rejected because
+// the secret has been modified since it was read.
+var ErrCASMismatch = errors.New("check-and-set parameter did not match the current version")
+
 // Vault represents a means for interacting with a remote Vault
 // instance (unsealed and pre-authenticated) to read and write secrets.
+// Secrets can be stored in a KV version 1 or version 2 secrets engine.
 type Vault struct {
 	Client     *vaultapi.Client
 	RenewToken bool
+	Auth       Authenticator // Auth method used to log in, nil when a static token is used
+	// Observe, if set, is called after each read, write and delete with the
+	// duration and the error of the operation
+	Observe func(operation string, duration time.Duration, err error)
+
+	mu          sync.Mutex
+	mounts      map[string]kvMount // KV mount of each secret path
+	tokenExpiry time.Time          // Expiry of the client token, zero if unknown
 }
 
 // Reader meant to be used by func that want to read in Vault
@@ -25,27 +43,34 @@ type Reader interface {
 
 // Writer meant to be used by func that want to write in Vault
 type Writer interface {
-	Write(path string, data map[string]interface{}) error
+	Write(path string, data map[string]interface{}, version int) (int, error)
 }
 
-// NewClient  creates a new vault client
-func NewClient(address string, proxy string, renew bool) (*Vault, error) {
+// NewClient  creates a new vault client.
+// tlsConfig holds optional CA bundles and client certificate. If it is nil, or
+// if it has no CA, the system's CAs are used.
+func NewClient(address string, proxy string, tlsConfig *vaultapi.TLSConfig, renew bool) (*Vault, error) {
 	config := vaultapi.DefaultConfig()
 
 	config.Address = address
 
-	// By default this added the system's CAs
-	if err := config.ConfigureTLS(&vaultapi.TLSConfig{Insecure: false}); err != nil {
-		return nil, fmt.Errorf("Failed to configure TLS: %v", err)
-	}
-
-	// Configure optionnal proxy
+	// Configure optionnal proxy. Keep the default transport so that the TLS
+	// configuration applies to proxied connections too.
 	if proxy != "" {
 		proxyURL, err := url.Parse(proxy)
 		if err != nil {
 			return nil, fmt.Errorf("Error parsing proxy URL: %v", err)
 		}
-		config.HttpClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		config.HttpClient.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &vaultapi.TLSConfig{}
+	}
+	// Never skip TLS verification
+	tlsConfig.Insecure = false
+	if err := config.ConfigureTLS(tlsConfig); err != nil {
+		return nil, fmt.Errorf("Failed to configure TLS: %v", err)
 	}
 
 	// Create the client
@@ -54,11 +79,94 @@ func NewClient(address string, proxy string, renew bool) (*Vault, error) {
 		return nil, fmt.Errorf("failed to create vault client: %s", err)
 	}
 
-	return &Vault{Client: client, RenewToken: renew}, nil
+	return &Vault{
+		Client:     client,
+		RenewToken: renew,
+		mounts:     make(map[string]kvMount),
+	}, nil
+}
+
+// SetNamespace sets the Vault Enterprise namespace used by every request of the client,
+// including token renewal and auth login. Secret paths are relative to this namespace.
+func (v *Vault) SetNamespace(namespace string) {
+	namespace = strings.Trim(namespace, "/")
+	if namespace == "" {
+		return
+	}
+	v.Client.SetNamespace(namespace)
+}
+
+// Namespace returns the Vault Enterprise namespace of the client, or an empty string
+func (v *Vault) Namespace() string {
+	return v.Client.Headers().Get(consts.NamespaceHeaderName)
 }
 
-// Read reads data from vault
+// Name identifies the vault by its address
+func (v *Vault) Name() string {
+	return v.Client.Address()
+}
+
+// Read reads data from vault.
+// Secrets from a KV version 2 mount are returned with the same {"data": {...}} shape
+// as KV version 1 secrets, along with their metadata.
 func (v *Vault) Read(path string) ([]byte, error) {
+	b, _, err := v.ReadVersion(path)
+	return b, err
+}
+
+// ReadVersion reads data from vault like Read, along with the version of the secret
+// to give to Write. The version is 0 for KV version 1 secrets and missing secrets.
+func (v *Vault) ReadVersion(path string) ([]byte, int, error) {
+	start := time.Now()
+	b, version, err := v.readSecret(path)
+	v.observe("read", start, err)
+	return b, version, err
+}
+
+// observe reports the duration and the error of an operation to the Observe hook
+func (v *Vault) observe(operation string, start time.Time, err error) {
+	if v.Observe != nil {
+		v.Observe(operation, time.Since(start), err)
+	}
+}
+
+func (v *Vault) readSecret(path string) ([]byte, int, error) {
+	m, err := v.mount(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := v.read(m.dataPath(path))
+	if err != nil || m.Version != 2 {
+		return b, 0, err
+	}
+
+	if b == nil {
+		// The secret may have been deleted while its metadata still exists
+		version, err := v.currentVersion(m, path)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, version, nil
+	}
+
+	var s kvSecret
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, 0, fmt.Errorf("Error decoding KV v2 secret: %v", err)
+	}
+	var md kvMetadata
+	if err := json.Unmarshal(s.Data.Metadata, &md); err != nil {
+		return nil, 0, fmt.Errorf("Error decoding KV v2 secret metadata: %v", err)
+	}
+
+	b, err = json.Marshal(map[string]json.RawMessage{
+		"data":     s.Data.Data,
+		"metadata": s.Data.Metadata,
+	})
+	return b, md.Version, err
+}
+
+// read issues a raw GET request on a path and returns the body of the response
+func (v *Vault) read(path string) ([]byte, error) {
 	r := v.Client.NewRequest("GET", "/v1/"+path)
 	resp, err := v.Client.RawRequest(r)
 	if resp != nil {
@@ -78,18 +186,64 @@ func (v *Vault) Read(path string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// Write writes a secret in vault
-func (v *Vault) Write(path string, data map[string]interface{}) error {
-	_, err := v.Client.Logical().Write(path, data)
+// Write writes a secret in vault and returns its new version.
+// On a KV version 2 mount, the write uses check-and-set with version, as returned
+// by ReadVersion, and fails with ErrCASMismatch if the secret has been modified
+// in between. A version of 0 only writes the secret if it does not exist.
+// KV version 1 secrets are written regardless of version.
+func (v *Vault) Write(path string, data map[string]interface{}, version int) (int, error) {
+	start := time.Now()
+	version, err := v.writeSecret(path, data, version)
+	v.observe("write", start, err)
+	return version, err
+}
+
+func (v *Vault) writeSecret(path string, data map[string]interface{}, version int) (int, error) {
+	m, err := v.mount(path)
 	if err != nil {
-		return fmt.Errorf("Error writing secret %s to vault: %v", path, err)
+		return 0, err
 	}
-	return nil
+	if m.Version != 2 {
+		if _, err := v.Client.Logical().Write(path, data); err != nil {
+			return 0, fmt.Errorf("Error writing secret %s to vault: %v", path, err)
+		}
+		return 0, nil
+	}
+
+	s, err := v.Client.Logical().Write(m.dataPath(path), map[string]interface{}{
+		"data":    data,
+		"options": map[string]interface{}{"cas": version},
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "check-and-set parameter did not match") {
+			return 0, ErrCASMismatch
+		}
+		return 0, fmt.Errorf("Error writing secret %s to vault: %v", path, err)
+	}
+	var newVersion int64
+	if s != nil {
+		if n, ok := s.Data["version"].(json.Number); ok {
+			newVersion, _ = n.Int64()
+		}
+	}
+	return int(newVersion), nil
 }
 
-// Delete a secret in vault
+// Delete a secret in vault.
+// On a KV version 2 mount, every version of the secret and its metadata are deleted.
 func (v *Vault) Delete(path string) error {
-	_, err := v.Client.Logical().Delete(path)
+	start := time.Now()
+	err := v.deleteSecret(path)
+	v.observe("delete", start, err)
+	return err
+}
+
+func (v *Vault) deleteSecret(path string) error {
+	m, err := v.mount(path)
+	if err != nil {
+		return err
+	}
+	_, err = v.Client.Logical().Delete(m.metadataPath(path))
 	if err != nil {
 		return fmt.Errorf("Error Deleting secret %s in vault: %v", path, err)
 	}
@@ -115,6 +269,7 @@ func (v *Vault) SelfRenew() error {
 	if !renewal.Auth.Renewable {
 		return errors.New("secret is not renewable")
 	}
+	v.setTokenExpiry(renewal.Auth.LeaseDuration)
 	return nil
 }
 
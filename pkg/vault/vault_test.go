@@ -0,0 +1,204 @@
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKVv2 is a minimal stand-in for a Vault server with a KV version 2 mount on secret/
+type fakeKVv2 struct {
+	data    map[string]interface{}
+	version int
+}
+
+func (f *fakeKVv2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/sys/internal/ui/mounts/secret/fernet-keys":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"path":    "secret/",
+				"type":    "kv",
+				"options": map[string]interface{}{"version": "2"},
+			},
+		})
+	case r.URL.Path == "/v1/secret/data/fernet-keys" && r.Method == "GET":
+		if f.data == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     f.data,
+				"metadata": map[string]interface{}{"version": f.version},
+			},
+		})
+	case r.URL.Path == "/v1/secret/data/fernet-keys" && r.Method == "PUT":
+		var body struct {
+			Data    map[string]interface{} `json:"data"`
+			Options map[string]int         `json:"options"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if cas, ok := body.Options["cas"]; ok && cas != f.version {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+			return
+		}
+		f.data = body.Data
+		f.version++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"version": f.version},
+		})
+	case r.URL.Path == "/v1/secret/metadata/fernet-keys" && r.Method == "GET":
+		if f.version == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"current_version": f.version},
+		})
+	case r.URL.Path == "/v1/secret/metadata/fernet-keys" && r.Method == "DELETE":
+		f.data = nil
+		f.version = 0
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestVault(t *testing.T, h http.Handler) (*Vault, *httptest.Server) {
+	srv := httptest.NewServer(h)
+	v, err := NewClient(srv.URL, "", nil, false)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("Error creating vault client: %v", err)
+	}
+	v.Client.SetToken("test")
+	return v, srv
+}
+
+func TestKVv2ReadWrite(t *testing.T) {
+	assert := assert.New(t)
+	kv := &fakeKVv2{}
+	v, srv := newTestVault(t, kv)
+	defer srv.Close()
+
+	b, version, err := v.ReadVersion("secret/fernet-keys")
+	assert.Nil(err)
+	assert.Nil(b, "Secret is not expected to exist")
+	assert.Equal(0, version)
+
+	version, err = v.Write("secret/fernet-keys", map[string]interface{}{"period": 3600}, version)
+	assert.Nil(err)
+	assert.Equal(1, version)
+
+	b, err = v.Read("secret/fernet-keys")
+	assert.Nil(err)
+	var s struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	assert.Nil(json.Unmarshal(b, &s))
+	assert.Equal(float64(3600), s.Data["period"], "Secret expected to be returned in KV v1 shape")
+
+	assert.Nil(v.Delete("secret/fernet-keys"))
+	assert.Nil(kv.data, "Secret expected to be deleted")
+}
+
+func TestKVv2CheckAndSet(t *testing.T) {
+	kv := &fakeKVv2{data: map[string]interface{}{"period": float64(3600)}, version: 3}
+	v, srv := newTestVault(t, kv)
+	defer srv.Close()
+
+	_, version, err := v.ReadVersion("secret/fernet-keys")
+	if err != nil {
+		t.Fatalf("Error reading secret: %v", err)
+	}
+	assert.Equal(t, 3, version)
+	// Another locksmith writes the secret in between
+	kv.version++
+
+	_, err = v.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, version)
+	assert.Equal(t, ErrCASMismatch, err)
+	assert.Equal(t, float64(3600), kv.data["period"], "Secret is not expected to be overwritten")
+}
+
+func TestKVv2InterleavedRead(t *testing.T) {
+	kv := &fakeKVv2{data: map[string]interface{}{"period": float64(3600)}, version: 3}
+	v, srv := newTestVault(t, kv)
+	defer srv.Close()
+
+	_, version, err := v.ReadVersion("secret/fernet-keys")
+	if err != nil {
+		t.Fatalf("Error reading secret: %v", err)
+	}
+	// Another locksmith writes the secret, then a health check reads it
+	kv.version++
+	_, err = v.Read("secret/fernet-keys")
+	assert.Nil(t, err)
+
+	_, err = v.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, version)
+	assert.Equal(t, ErrCASMismatch, err, "A read is not expected to change the version of a write")
+	assert.Equal(t, float64(3600), kv.data["period"], "Secret is not expected to be overwritten")
+}
+
+func TestKVv1Fallback(t *testing.T) {
+	var paths []string
+	v, srv := newTestVault(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if strings.HasPrefix(r.URL.Path, "/v1/sys/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"period": 3600}}`))
+	}))
+	defer srv.Close()
+
+	b, err := v.Read("secret/fernet-keys")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"data": {"period": 3600}}`, string(b))
+	_, err = v.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"GET /v1/sys/internal/ui/mounts/secret/fernet-keys",
+		"GET /v1/secret/fernet-keys",
+		"PUT /v1/secret/fernet-keys",
+	}, paths)
+}
+
+func TestMountLookupError(t *testing.T) {
+	assert := assert.New(t)
+	kv := &fakeKVv2{data: map[string]interface{}{"period": float64(3600)}, version: 1}
+	var mu sync.Mutex
+	sealed := true
+	v, srv := newTestVault(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if sealed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"errors":["Vault is sealed"]}`))
+			return
+		}
+		kv.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	v.Client.SetMaxRetries(0)
+
+	_, err := v.Read("secret/fernet-keys")
+	assert.NotNil(err, "Read is expected to fail while the mount cannot be looked up")
+	_, err = v.Write("secret/fernet-keys", map[string]interface{}{"period": 1800}, 1)
+	assert.NotNil(err)
+
+	// The KV version is looked up again once the vault is available
+	mu.Lock()
+	sealed = false
+	mu.Unlock()
+	b, version, err := v.ReadVersion("secret/fernet-keys")
+	assert.Nil(err)
+	assert.Contains(string(b), `"period":3600`)
+	assert.Equal(1, version)
+}